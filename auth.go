@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Credentials holds the accounts allowed to use the client listener.
+// Passwords are kept either in plain text or as htpasswd {SHA} digests.
+type Credentials struct {
+	users map[string]string
+}
+
+// cryptHash matches the modular crypt hashes htpasswd makes by default,
+// such as $apr1$ and $2y$ (bcrypt), which are not supported.
+var cryptHash = regexp.MustCompile(`^\$[0-9a-z]+\$`)
+
+// desHash matches a traditional crypt hash (htpasswd -d), not supported
+// either. Only file entries are taken for one, a password given on the
+// command line is plain text whatever it looks like.
+var desHash = regexp.MustCompile(`^[./0-9A-Za-z]{13}$`)
+
+func loadCredentials(pairs []string, file string) (*Credentials, error) {
+	cred := &Credentials{users: make(map[string]string)}
+	for _, pair := range pairs {
+		if err := cred.add(pair, false); err != nil {
+			return nil, err
+		}
+	}
+	if file == "" {
+		return cred, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := cred.add(line, true); err != nil {
+			return nil, err
+		}
+	}
+	return cred, scanner.Err()
+}
+
+func (cred *Credentials) add(pair string, htpasswd bool) error {
+	i := strings.IndexByte(pair, ':')
+	if i <= 0 {
+		return fmt.Errorf("invalid credential %q, expect user:password", pair)
+	}
+	if m := cryptHash.FindString(pair[i+1:]); m != "" {
+		return fmt.Errorf("password of %q hashed as %s, only {SHA} (htpasswd -s) and plain text are supported", pair[:i], m)
+	}
+	if htpasswd && desHash.MatchString(pair[i+1:]) {
+		return fmt.Errorf("password of %q looks like a crypt hash (htpasswd -d), only {SHA} (htpasswd -s) and plain text are supported", pair[:i])
+	}
+	cred.users[pair[:i]] = pair[i+1:]
+	return nil
+}
+
+// Validate reports whether user is known and pass matches its password.
+func (cred *Credentials) Validate(user, pass string) bool {
+	stored, ok := cred.users[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(stored, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		pass = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1
+}
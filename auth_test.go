@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "htpasswd")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// htpasswd -bs: alice secret
+	write("# comment\nalice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n\nbob:plain\n")
+	cred, err := loadCredentials([]string{"carol:abJnggxhB/yWI"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", false},
+		{"bob", "plain", true},
+		{"bob", "Plain", false},
+		{"carol", "abJnggxhB/yWI", true}, // plain text on the command line
+		{"dave", "", false},
+	}
+	for _, c := range checks {
+		if cred.Validate(c.user, c.pass) != c.ok {
+			t.Errorf("%s:%s: expect valid %v", c.user, c.pass, c.ok)
+		}
+	}
+
+	for _, entry := range []string{
+		"alice:$apr1$7dF3r1h0$Vr2OtNhjYoVbXnvOM3vzM/",
+		"alice:$2y$05$5QEeTfBNWexbpL6Ke7ZiFuS9e6X1MzCzhxEftWhAI5PXA5Ndw3hMe",
+		"alice:abJnggxhB/yWI",
+		"nocolon",
+	} {
+		write(entry + "\n")
+		if _, err := loadCredentials(nil, file); err == nil {
+			t.Errorf("%s: accepted", entry)
+		}
+	}
+}
+
+// TestSocksAuth logs in with RFC 1929 before a CONNECT, and is turned away
+// with a wrong password.
+func TestSocksAuth(t *testing.T) {
+	startServer(t)
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	cred, err := loadCredentials([]string{"alice:secret"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := startClient(t, &Client{Auth: cred})
+
+	login := func(pass string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2)
+		// VER NMETHODS METHODS, then VER METHOD
+		if _, err = conn.Write([]byte{5, 2, MethodNoAuth, MethodUserPass}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(conn, buf); err != nil || buf[1] != MethodUserPass {
+			t.Fatalf("method %x, want username/password: %v", buf, err)
+		}
+		// VER ULEN UNAME PLEN PASSWD, then VER STATUS
+		req := append([]byte{1, 5}, "alice"...)
+		req = append(append(req, byte(len(pass))), pass...)
+		if _, err = conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		return conn, buf[1]
+	}
+
+	conn, status := login("secret")
+	if status != 0 {
+		t.Fatalf("login refused with status %d", status)
+	}
+	if rep, _ := socksCommand(t, conn, CmdConnect, dest.Addr().String()); rep != 0 {
+		t.Errorf("connect after login refused with %d", rep)
+	}
+
+	conn, status = login("wrong")
+	if status == 0 {
+		t.Fatal("wrong password accepted")
+	}
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection left open after a failed login")
+	}
+
+	// no method in common
+	conn, err = net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err = conn.Write([]byte{5, 1, MethodNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, buf); err != nil || buf[1] != MethodNoAcceptable {
+		t.Errorf("method %x without credentials, want no acceptable methods: %v", buf, err)
+	}
+}
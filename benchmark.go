@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"net/url"
+	"sync/atomic"
 	"time"
 )
 
 type Benchmark struct {
 	Connections int
 	Block       int
+	Streams     int  // loops running at once
+	NoDelay     bool // streams skip coalescing
 	ServerAddr  *url.URL
 	Dialer      *websocket.Dialer
 	CreatedAt   time.Time
@@ -21,33 +24,64 @@ func (client *Benchmark) Bench() (err error) {
 		wsKeys = append(wsKeys, genRandBytes(wsAddrLen))
 	}
 	wsLen = client.Connections
-	mainServer = client.ServerAddr.String()
+	serverPool, err = parseUpstreams([]string{client.ServerAddr.String()}, balanceRoundRobin)
+	if err != nil {
+		return
+	}
 
 	data := genRandBytes(client.Block)
+	for i := 1; i < client.Streams; i++ {
+		go client.loop(data)
+	}
+	client.loop(data)
+	return
+}
+
+// benchRounds and benchRTT sum up the loops answered, for benchStats.
+var benchRounds, benchRTT int64
+
+// loop sends data in a loop frame over a new stream at a time, timing the
+// close frame that echoes it.
+func (client *Benchmark) loop(data []byte) {
 	for {
 		//log.Warn("initializing data package...")
-		c := &muxConn{
-			id: genRandBytes(connAddrLen),
-			ws: wsPool.getWs(),
-		}
-		_, err = c.bench(data)
+		c := createConn(nil)
+		c.noDelay = client.NoDelay
+		start := time.Now()
+		_, err := c.bench(data)
 		if err != nil {
 			log.Warnf(err.Error())
+			_ = c.Close()
+			continue
+		}
+		select {
+		case <-c.done:
+			atomic.AddInt64(&benchRounds, 1)
+			atomic.AddInt64(&benchRTT, int64(time.Since(start)))
+		case <-time.After(replyTimeout):
+			log.Warnf("loop %x not answered in %v", c.id, replyTimeout)
+			_ = c.Close()
 		}
-		_ = c.Close()
 	}
 }
 
 func benchStats() {
-	var ou, od int64
+	var ou, od, or, ot int64
 	for {
 		time.Sleep(time.Second)
 		speedUp := uploaded - ou
 		speedDown := downloaded - od
-		log.Infof("stats: uploaded %s | %s/s, downloaded %s | %s/s",
-			ByteCountSI(uploaded), ByteCountSI(speedUp), ByteCountSI(downloaded), ByteCountSI(speedDown))
+		r, t := atomic.LoadInt64(&benchRounds), atomic.LoadInt64(&benchRTT)
+		var avg time.Duration
+		if r > or {
+			avg = time.Duration((t - ot) / (r - or))
+		}
+		log.Infof("stats: uploaded %s | %s/s, downloaded %s | %s/s, %d loops/s, rtt %v",
+			ByteCountSI(uploaded), ByteCountSI(speedUp), ByteCountSI(downloaded), ByteCountSI(speedDown),
+			r-or, avg.Round(time.Microsecond))
 		ou = uploaded
 		od = downloaded
+		or, ot = r, t
 	}
 }
 
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// bindTimeout limits how long a BIND listener waits for the inbound peer.
+const bindTimeout = 2 * time.Minute
+
+func (client *Client) handleBind(conn *bufConn, addr Addr) {
+	// conn is attached after the replies, as in connect
+	c := createConn(nil)
+	_, err := c.bind(addr)
+	if err != nil {
+		_ = writeReply(conn, byte(ErrGeneralFailure), nil)
+		_ = conn.Close()
+		_ = c.Close()
+		return
+	}
+
+	// first reply carries the listening address, second one the peer
+	for i := 0; i < 2; i++ {
+		rep, bnd, err := c.waitReply(bindTimeout + 10*time.Second)
+		if err != nil {
+			log.Debugf("connection %x, bind error: %v", c.id, err)
+			_ = writeReply(conn, byte(ErrGeneralFailure), nil)
+			_ = conn.Close()
+			_ = c.Close()
+			return
+		}
+		err = writeReply(conn, rep, bnd)
+		if err != nil || rep != 0 {
+			_ = conn.SetLinger(-1)
+			_ = conn.Close()
+			_ = c.Close()
+			return
+		}
+	}
+	if !c.attach(conn) {
+		_ = conn.Close()
+		return
+	}
+
+	err = transfer.Invoke(&dataPack{
+		netConn: conn,
+		muxConn: c,
+	})
+	if err != nil {
+		log.Warnf("invoke error: %v", err)
+		_ = c.Close()
+		return
+	}
+}
+
+func (server *Server) bindHandler(host string, c *muxConn) {
+	log.Debugf("connection %x, bind for %s", c.id, host)
+
+	ln, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		log.Warn("bind error: ", err)
+		_, _ = c.reply(byte(ErrGeneralFailure), nil)
+		_ = c.Close()
+		return
+	}
+	c.ln = ln
+
+	// advertise the address the client reached us at
+	ip := c.ws.conn.LocalAddr().(*net.TCPAddr).IP
+	port := ln.Addr().(*net.TCPAddr).Port
+	_, err = c.reply(0, ParseAddr(net.JoinHostPort(ip.String(), strconv.Itoa(port))))
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+
+	// DST.ADDR restricts the accepted peer when given as an ip
+	var expected net.IP
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if ip := net.ParseIP(h); ip != nil && !ip.IsUnspecified() {
+			expected = ip
+		}
+	}
+
+	_ = ln.SetDeadline(time.Now().Add(bindTimeout))
+	var conn *net.TCPConn
+	for {
+		conn, err = ln.AcceptTCP()
+		if err != nil {
+			log.Debugf("connection %x, bind accept error: %v", c.id, err)
+			_, _ = c.reply(byte(ErrGeneralFailure), nil)
+			_ = c.Close()
+			return
+		}
+		if expected == nil || conn.RemoteAddr().(*net.TCPAddr).IP.Equal(expected) {
+			break
+		}
+		_ = conn.Close()
+	}
+	_ = ln.Close()
+	if !c.attach(conn) {
+		_ = conn.Close()
+		return
+	}
+
+	_, err = c.reply(0, ParseAddr(conn.RemoteAddr().String()))
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+
+	err = transfer.Invoke(&dataPack{
+		netConn: conn,
+		muxConn: c,
+	})
+	if err != nil {
+		log.Warnf("invoke error: %v", err)
+		_ = c.Close()
+		return
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// TestBind gets the listening address in a first reply, the peer that
+// connected to it in a second one and then data both ways.
+func TestBind(t *testing.T) {
+	startServer(t)
+	conn, rep, bnd := socksRequest(t, startClient(t, new(Client)), CmdBind, "127.0.0.1:0")
+	if rep != 0 {
+		t.Fatalf("bind refused with %d", rep)
+	}
+
+	peer, err := net.Dial("tcp", bnd.String())
+	if err != nil {
+		t.Fatalf("listening address %s: %v", bnd, err)
+	}
+	defer peer.Close()
+	rep, from := readReply(t, conn)
+	if rep != 0 || from.String() != peer.LocalAddr().String() {
+		t.Fatalf("second reply %d %s, want 0 %s", rep, from, peer.LocalAddr())
+	}
+
+	if _, err = peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("client got %q %v", buf, err)
+	}
+	if _, err = conn.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(peer, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("peer got %q %v", buf, err)
+	}
+}
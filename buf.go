@@ -93,5 +93,7 @@ func (w *PipeWriter) CloseWithError(err error) error {
 		err = io.EOF
 	}
 	w.rErr = err
+	// wake up a reader waiting for data
+	w.cond.Broadcast()
 	return nil
 }
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"github.com/gorilla/websocket"
+	"io"
 	"net"
-	"net/url"
 	"os"
 	"time"
 )
@@ -11,8 +12,19 @@ import (
 type Client struct {
 	Connections   int
 	ListenTCPAddr *net.TCPAddr
-	ServerAddr    *url.URL
+	Servers       *upstreams
+	Identity      string
 	Dialer        *websocket.Dialer
+	Auth          *Credentials
+	RedirectAddr  *net.TCPAddr
+	TProxyAddr    *net.TCPAddr
+	Forwards      []*Forward
+	Remotes       []*Reverse
+	DNSAddr       *net.TCPAddr
+	Router        *Router
+	PACAddr       string
+	NoDelayPorts  []portRange // destinations of latency sensitive streams
+	dnsCache      *dnsCache
 	CreatedAt     time.Time
 }
 
@@ -22,7 +34,37 @@ func (client *Client) Listen() {
 		wsKeys = append(wsKeys, genRandBytes(wsAddrLen))
 	}
 	wsLen = client.Connections
-	mainServer = client.ServerAddr.String()
+	serverPool = client.Servers
+	identity = client.Identity
+	if len(serverPool.list) > 1 {
+		go serverPool.check()
+	}
+	if client.RedirectAddr != nil {
+		go client.listenRedirect()
+	}
+	if client.TProxyAddr != nil {
+		go client.listenTProxy()
+	}
+	for _, f := range client.Forwards {
+		go client.listenForward(f)
+	}
+	for _, r := range client.Remotes {
+		go client.listenRemote(r)
+	}
+	if client.DNSAddr != nil || client.Router != nil {
+		client.dnsCache = newDNSCache()
+	}
+	if client.Router != nil {
+		// a local lookup would tell the network what is visited
+		client.Router.lookup = client.lookupIP
+		go client.Router.watch()
+	}
+	if client.PACAddr != "" {
+		go client.listenPAC()
+	}
+	if client.DNSAddr != nil {
+		go client.listenDNS()
+	}
 	log.Infof("Listening at %s", client.ListenTCPAddr.String())
 
 	client.listenTCP()
@@ -35,6 +77,11 @@ func (client *Client) listenTCP() {
 		os.Exit(1)
 	}
 
+	client.serve(listener, client.handleConn)
+}
+
+func (client *Client) serve(listener *net.TCPListener, handle func(*net.TCPConn)) {
+	var err error
 	defer func() {
 		err = listener.Close()
 		if err != nil {
@@ -49,39 +96,151 @@ func (client *Client) listenTCP() {
 			continue
 		}
 
-		go client.handleConn(conn)
+		go handle(conn)
 	}
 }
 
-func (client *Client) handleConn(conn *net.TCPConn) {
+// bufConn keeps the bytes peeked while detecting the inbound protocol.
+type bufConn struct {
+	*net.TCPConn
+	r          *bufio.Reader
+	redirected bool // steered to us by iptables
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// WriteTo hides the one of *net.TCPConn, which would skip buffered bytes.
+func (c *bufConn) WriteTo(w io.Writer) (int64, error) {
+	return c.r.WriteTo(w)
+}
+
+func (client *Client) handleConn(tcpConn *net.TCPConn) {
+
+	err := tcpConn.SetLinger(0)
+	if err != nil {
+		_ = tcpConn.Close()
+		return
+	}
 
-	err := conn.SetLinger(0)
+	conn := &bufConn{TCPConn: tcpConn, r: bufio.NewReader(tcpConn)}
+	ver, err := conn.r.Peek(1)
 	if err != nil {
 		_ = conn.Close()
 		return
 	}
 
-	addr, err := Handshake(conn)
+	switch ver[0] {
+	case 4:
+		addr, err := Handshake4(conn, client.Auth != nil)
+		if err != nil {
+			_ = conn.SetLinger(-1)
+			_ = conn.Close()
+			return
+		}
+		log.Debugln(addr.String())
+		client.connect(conn, addr, func(rep byte, _ Addr) error {
+			return writeReply4(conn, rep)
+		})
+		return
+	case 5:
+	default:
+		if ver[0] >= 'A' && ver[0] <= 'Z' {
+			client.handleHTTP(conn)
+			return
+		}
+		_ = conn.Close()
+		return
+	}
+
+	cmd, addr, err := Handshake(conn, client.Auth)
 	if err != nil {
 		_ = conn.Close()
 		return
 	}
 
 	log.Debugln(addr.String())
-	ws := createConn(conn)
+	switch cmd {
+	case CmdBind:
+		client.handleBind(conn, addr)
+	case CmdUDPAssociate:
+		client.handleAssociate(conn)
+	default:
+		client.connect(conn, addr, func(rep byte, bnd Addr) error {
+			return writeReply(conn, rep, bnd)
+		})
+	}
+}
+
+// connect dials addr through the websocket and splices conn into the
+// stream, reporting the outcome with reply before any data flows.
+func (client *Client) connect(conn *bufConn, addr Addr, reply func(rep byte, bnd Addr) error) {
+	if client.Router != nil {
+		switch client.Router.Route(addr) {
+		case ActionDirect:
+			if !conn.redirected {
+				client.direct(conn, addr, reply)
+				return
+			}
+			// iptables would steer the direct dial back to us
+			log.Debugf("connection to %s redirected, proxied instead of direct", addr)
+		case ActionReject:
+			log.Debugf("connection to %s rejected by rules", addr)
+			_ = reply(byte(ErrConnectionNotAllowed), nil)
+			_ = conn.SetLinger(-1)
+			_ = conn.Close()
+			return
+		}
+	}
+
+	// conn is attached once the reply is out, so that a close frame from
+	// the server can not reset it before the peer has read the reply
+	ws := createConn(nil)
+	ws.noDelay = client.noDelay(addr)
+
+	_, err := ws.dial(addr)
+	if err != nil {
+		_ = reply(byte(ErrGeneralFailure), nil)
+		_ = conn.Close()
+		_ = ws.Close()
+		return
+	}
 
-	_, err = ws.dial(addr)
+	// reply only once the server knows the outcome of the dial, servers
+	// speaking v1 may predate replies and are assumed to succeed
+	var rep byte
+	var bnd Addr
+	if ws.ws.version >= protocolV2 {
+		rep, bnd, err = ws.waitReply(replyTimeout)
+	}
 	if err != nil {
+		log.Debugf("connection %x, dial %s: %v", ws.id, addr, err)
+		rep = byte(replyCode(err))
+	}
+	err = reply(rep, bnd)
+	if err != nil || rep != 0 {
+		// let the failure reply reach the peer instead of a reset
+		_ = conn.SetLinger(-1)
+		_ = conn.Close()
 		_ = ws.Close()
 		return
 	}
+	if !ws.attach(conn) {
+		// closed by the server right after the reply
+		_ = conn.Close()
+		return
+	}
+	if ws.remote != nil {
+		log.Debugf("connection %x, %s reached at %s", ws.id, addr, ws.remote)
+	}
 
 	err = transfer.Invoke(&dataPack{
 		netConn: conn,
 		muxConn: ws,
 	})
 	if err != nil {
-		log.Warn("invoke error: %V", err)
+		log.Warnf("invoke error: %v", err)
 		_ = ws.Close()
 		return
 	}
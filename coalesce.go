@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Over v2 small frames written close together share a websocket message,
+// and so a hash and a write, instead of taking one each. Data and loop
+// frames may wait for coalesceDelay, or until coalesceBytes are pending;
+// any other frame, and those of latency sensitive streams, goes out at
+// once along with what is pending, so frames keep their order. A session
+// numbers the message once, however many frames it carries.
+var (
+	coalesceDelay = 2 * time.Millisecond
+	coalesceBytes = 16 * 1024
+)
+
+// setCoalesce sets how long frames may wait for others, 0 disables
+// coalescing.
+func setCoalesce(delay time.Duration) error {
+	if delay < 0 || delay > time.Second {
+		return fmt.Errorf("coalesce delay %v out of 0 to 1s", delay)
+	}
+	coalesceDelay = delay
+	return nil
+}
+
+// queued sends the pending message after a frame was added to it, unless
+// the frame may wait. Called holding ws.lock.
+func (ws *webSocket) queued(later bool) error {
+	if !later || coalesceDelay <= 0 || len(ws.pending) >= coalesceBytes {
+		return ws.flush()
+	}
+	if ws.flushTimer == nil {
+		ws.flushTimer = time.AfterFunc(coalesceDelay, func() {
+			ws.lock.Lock()
+			defer ws.lock.Unlock()
+			if err := ws.flush(); err != nil {
+				log.Warnf("websocket %v flush: %v", u64(ws.id), err)
+			}
+		})
+	}
+	return nil
+}
+
+// flush sends the pending frames as one message, called holding ws.lock.
+func (ws *webSocket) flush() error {
+	if ws.flushTimer != nil {
+		ws.flushTimer.Stop()
+		ws.flushTimer = nil
+	}
+	if len(ws.pending) == 0 {
+		return nil
+	}
+	frames := ws.pending
+	if ws.session == nil {
+		ws.pending = frames[:0]
+		if err := ws.writeFrames(frames); err != nil {
+			// frames that waited were taken as written, their streams can
+			// not go on without them: later writes fail and closing the
+			// connection ends the websocket along with its streams
+			ws.writeErr = err
+			_ = ws.conn.Close()
+			return err
+		}
+		return nil
+	}
+	// kept for resending, the next message needs a buffer of its own
+	ws.pending = nil
+	ws.session.keep(frames)
+	if ws.session.resending {
+		return nil
+	}
+	if err := ws.writeFrames(frames); err != nil {
+		log.Debugf("websocket %v write: %v, resent once resumed", u64(ws.id), err)
+	}
+	return nil
+}
+
+// noDelay tells whether streams to addr are latency sensitive.
+func (client *Client) noDelay(addr Addr) bool {
+	if len(client.NoDelayPorts) == 0 {
+		return false
+	}
+	_, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(portStr)
+	for _, r := range client.NoDelayPorts {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// frameFlags returns the header flags of the dial or loop frame opening c.
+func (c *muxConn) frameFlags() uint16 {
+	if c.noDelay {
+		return frameNoDelay
+	}
+	return 0
+}
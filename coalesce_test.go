@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCoalesce sends loop frames that may wait, which share a message, and
+// one of a latency sensitive stream, which goes out at once.
+func TestCoalesce(t *testing.T) {
+	startServer(t)
+	var err error
+	defer func(d time.Duration) { coalesceDelay = d }(coalesceDelay)
+	if err = setCoalesce(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := startWs(genRandBytes(wsAddrLen))
+	defer ws.close()
+	if ws.session == nil {
+		t.Fatal("no session, messages can not be counted")
+	}
+	sent := func() uint64 {
+		ws.lock.Lock()
+		defer ws.lock.Unlock()
+		return ws.session.sent
+	}
+	var streams []*muxConn
+	for i := 0; i < 3; i++ {
+		c := &muxConn{ws: ws, done: make(chan struct{})}
+		ws.openStream(c)
+		if _, err = c.bench([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, c)
+	}
+	if n := sent(); n != 0 {
+		t.Fatalf("%d messages sent before the delay", n)
+	}
+
+	c := &muxConn{ws: ws, done: make(chan struct{}), noDelay: true}
+	ws.openStream(c)
+	if _, err = c.bench([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n := sent(); n != 1 {
+		t.Fatalf("%d messages sent for four frames, want 1", n)
+	}
+	for _, c := range append(streams, c) {
+		select {
+		case <-c.done:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("loop %x not answered", c.id)
+		}
+	}
+}
+
+// TestCoalesceLost fails the streams of a websocket without session whose
+// delayed frames could not be sent, instead of dropping them unnoticed.
+func TestCoalesceLost(t *testing.T) {
+	startServer(t)
+	defer func(d time.Duration) { coalesceDelay = d }(coalesceDelay)
+	coalesceDelay = 50 * time.Millisecond
+	// a server keeping no sessions
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Session")
+		server.HandleWebSocket(w, r)
+	}))
+	defer srv.Close()
+	var err error
+	serverPool, err = parseUpstreams([]string{"ws" + strings.TrimPrefix(srv.URL, "http")}, balanceRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws := startWs(genRandBytes(wsAddrLen))
+	defer ws.close()
+	if ws.session != nil {
+		t.Fatal("session kept, frames would be resent")
+	}
+	c := &muxConn{ws: ws, done: make(chan struct{})}
+	ws.openStream(c)
+	// writes fail from now on, reads still work
+	ws.lock.Lock()
+	_ = ws.conn.UnderlyingConn().(*net.TCPConn).CloseWrite()
+	ws.lock.Unlock()
+	if _, err := c.bench([]byte("hello")); err != nil {
+		t.Fatalf("delayed frame failed at once: %v", err)
+	}
+	time.Sleep(4 * coalesceDelay)
+	if _, err := c.bench([]byte("hello")); err == nil {
+		t.Error("write after a lost frame succeeded")
+	}
+	select {
+	case <-c.done:
+	case <-time.After(3 * time.Second):
+		t.Error("stream left open after a lost frame")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Address family preferences of the server dialer.
+const (
+	familyAuto      = "auto"
+	familyIPv4Only  = "ipv4-only"
+	familyIPv6Only  = "ipv6-only"
+	familyIPv4First = "ipv4-first"
+	familyIPv6First = "ipv6-first"
+)
+
+// attemptDelay is the head start of an address over the next one, the
+// Connection Attempt Delay of RFC 8305 section 5.
+const attemptDelay = 250 * time.Millisecond
+
+func validFamily(family string) bool {
+	switch family {
+	case familyAuto, familyIPv4Only, familyIPv6Only, familyIPv4First, familyIPv6First:
+		return true
+	}
+	return false
+}
+
+// sortAddrs orders ips by family preference, alternating between the
+// families as RFC 8305 section 4 asks. auto prefers IPv6.
+func sortAddrs(ips []net.IP, family string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	switch family {
+	case familyIPv4Only:
+		return v4
+	case familyIPv6Only:
+		return v6
+	case familyIPv4First:
+		first, second = v4, v6
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// withTimeout bounds ctx by timeout, 0 leaving it unbounded.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// dialRace returns the first connection made to one of ips. Attempts start
+// attemptDelay apart, or right away once the previous one failed, each
+// bounded by timeout unless it is 0; the others are cancelled when one
+// succeeds.
+func dialRace(ctx context.Context, ips []net.IP, timeout time.Duration,
+	dial func(ctx context.Context, ip net.IP) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	var delay <-chan time.Time
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			ctx, cancel := withTimeout(ctx, timeout)
+			defer cancel()
+			conn, err := dial(ctx, ip)
+			results <- result{conn, err}
+		}()
+		delay = nil
+		if next < len(ips) {
+			delay = time.After(attemptDelay)
+		}
+	}
+
+	start()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close connections made while this one was returned
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			log.Debugf("dial attempt failed: %v", r.err)
+			lastErr = r.err
+			if next < len(ips) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, lastErr
+}
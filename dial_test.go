@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSortAddrs(t *testing.T) {
+	var ips []net.IP
+	for _, s := range []string{"1.1.1.1", "1.0.0.1", "2606::1", "2606::2", "2606::3"} {
+		ips = append(ips, net.ParseIP(s))
+	}
+	cases := map[string]string{
+		familyAuto:      "[2606::1 1.1.1.1 2606::2 1.0.0.1 2606::3]",
+		familyIPv4First: "[1.1.1.1 2606::1 1.0.0.1 2606::2 2606::3]",
+		familyIPv4Only:  "[1.1.1.1 1.0.0.1]",
+		familyIPv6Only:  "[2606::1 2606::2 2606::3]",
+	}
+	for family, expect := range cases {
+		if got := fmt.Sprint(sortAddrs(ips, family)); got != expect {
+			t.Errorf("%s: expect %s, got %s", family, expect, got)
+		}
+	}
+}
+
+func TestDialRace(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the first address hangs, the second is refused, the third answers
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.1")}
+	dial := func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		switch ip.String() {
+		case "2001:db8::1":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case "192.0.2.1":
+			return nil, errors.New("refused")
+		}
+		return new(net.Dialer).DialContext(ctx, "tcp", ln.Addr().String())
+	}
+	start := time.Now()
+	conn, err := dialRace(context.Background(), ips, time.Second, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	// one delay for the second address, the third follows its failure
+	if d := time.Since(start); d < attemptDelay || d > 3*attemptDelay {
+		t.Errorf("expect the answer after about %v, got %v", attemptDelay, d)
+	}
+
+	// no attempt timeout leaves the hanging attempt to the race
+	if conn, err = dialRace(context.Background(), ips, 0, dial); err != nil {
+		t.Fatalf("without attempt timeout: %v", err)
+	}
+	_ = conn.Close()
+
+	_, err = dialRace(context.Background(), ips[:1], 50*time.Millisecond, dial)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect the attempt timeout, got %v", err)
+	}
+}
+
+// TestChainDial passes names on to a socks5h proxy and gives up on a proxy
+// that does not answer once the attempt is cancelled.
+func TestChainDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	targets := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, MaxAddrLen)
+		// VER NMETHODS METHODS
+		if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{5, MethodNoAuth})
+		// VER CMD RSV ATYP DST.ADDR DST.PORT
+		if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+			return
+		}
+		target, err := readAddr(conn, buf)
+		if err != nil {
+			return
+		}
+		targets <- target.String()
+		_, _ = conn.Write(append([]byte{5, 0, 0}, ParseAddr("127.0.0.1:1")...))
+	}()
+
+	d, err := parseChain("socks5h://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.remoteDNS() {
+		t.Fatal("socks5h resolves locally")
+	}
+	conn, err := d.DialContext(context.Background(), "example.com:80", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if target := <-targets; target != "example.com:80" {
+		t.Errorf("proxy asked for %s, want the name", target)
+	}
+
+	// accepted by the backlog, never answered
+	mute, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mute.Close()
+	d, _ = parseChain("socks5://" + mute.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = d.DialContext(ctx, "127.0.0.1:80", nil); err == nil {
+		t.Fatal("dialed through a proxy that never answered")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled handshake took %v", elapsed)
+	}
+}
+
+// TestChainPolicy resolves names itself for a socks5h proxy while private
+// destinations are denied, so that they are checked, and leaves them to the
+// proxy otherwise.
+func TestChainPolicy(t *testing.T) {
+	startServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	targets := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, MaxAddrLen)
+			if _, err := io.ReadFull(conn, buf[:3]); err == nil {
+				_, _ = conn.Write([]byte{5, MethodNoAuth})
+			}
+			if _, err := io.ReadFull(conn, buf[:3]); err == nil {
+				if target, err := readAddr(conn, buf); err == nil {
+					targets <- target.String()
+					_, _ = conn.Write(append([]byte{5, 0, 0}, ParseAddr("127.0.0.1:1")...))
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+	defer func(chain *chainDialer, policy *Policy) {
+		server.Chain, server.Policy = chain, policy
+	}(server.Chain, server.Policy)
+	if server.Chain, err = parseChain("socks5h://" + ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	proxy := startClient(t, new(Client))
+
+	server.Policy = &Policy{DenyPrivate: true}
+	if _, rep, _ := socksRequest(t, proxy, CmdConnect, "localhost:80"); Error(rep) != ErrConnectionNotAllowed {
+		t.Errorf("private name through socks5h replied %d", rep)
+	}
+	select {
+	case target := <-targets:
+		t.Errorf("denied destination reached the proxy as %s", target)
+	default:
+	}
+
+	server.Policy = &Policy{}
+	if _, rep, _ := socksRequest(t, proxy, CmdConnect, "localhost:80"); rep != 0 {
+		t.Errorf("connect through socks5h replied %d", rep)
+	}
+	if target := <-targets; target != "localhost:80" {
+		t.Errorf("proxy asked for %s, want the name", target)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsTimeout     = 5 * time.Second
+	dnsMaxSize     = 64 * 1024
+	dnsCacheSize   = 4096
+	dnsNegativeTTL = 60
+
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsTypeOPT  = 41
+
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+var (
+	errDNSMessage = errors.New("malformed dns message")
+	errDNSFailed  = errors.New("dns query failed")
+)
+
+// dnsMessage is what the cache needs from a dns message: the key of its
+// question and where the ttl of every record sits, along with the
+// addresses answered.
+type dnsMessage struct {
+	key     string
+	rcode   byte
+	trunc   bool
+	answers int
+	ttls    []int
+	minTTL  uint32
+	negTTL  uint32 // from the SOA record as RFC 2308, for negative answers
+	ips     []net.IP
+}
+
+// parseDNS walks msg without allocating names except for the question.
+func parseDNS(msg []byte) (*dnsMessage, error) {
+	if len(msg) < 12 {
+		return nil, errDNSMessage
+	}
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	m := &dnsMessage{
+		rcode:   msg[3] & 0x0f,
+		trunc:   msg[2]&0x02 != 0,
+		answers: an,
+		minTTL:  ^uint32(0),
+		negTTL:  dnsNegativeTTL,
+	}
+	qd := binary.BigEndian.Uint16(msg[4:])
+	rr := an + int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+	if qd != 1 {
+		return nil, errDNSMessage
+	}
+
+	name, off, err := dnsName(msg, 12)
+	if err != nil || off+4 > len(msg) {
+		return nil, errDNSMessage
+	}
+	// NAME QTYPE QCLASS
+	m.key = strings.ToLower(name) + string(msg[off:off+4])
+	off += 4
+
+	for i := 0; i < rr; i++ {
+		_, off, err = dnsName(msg, off)
+		if err != nil || off+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		// TYPE CLASS TTL RDLENGTH RDATA
+		typ := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		if typ != dnsTypeOPT {
+			m.ttls = append(m.ttls, off+4)
+			if ttl < m.minTTL {
+				m.minTTL = ttl
+			}
+		}
+		rdata := off + 10
+		off = rdata + int(binary.BigEndian.Uint16(msg[off+8:]))
+		if off > len(msg) {
+			return nil, errDNSMessage
+		}
+		// MNAME RNAME SERIAL REFRESH RETRY EXPIRE MINIMUM, MINIMUM last
+		if i >= an && typ == dnsTypeSOA && off-rdata >= 22 {
+			if min := binary.BigEndian.Uint32(msg[off-4:]); min < ttl {
+				ttl = min
+			}
+			m.negTTL = ttl
+		}
+		if i < an && (typ == dnsTypeA && off-rdata == net.IPv4len || typ == dnsTypeAAAA && off-rdata == net.IPv6len) {
+			m.ips = append(m.ips, net.IP(append([]byte(nil), msg[rdata:off]...)))
+		}
+	}
+	return m, nil
+}
+
+// dnsName reads the possibly compressed name at off, returning the offset
+// right after it.
+func dnsName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, errDNSMessage
+}
+
+type dnsEntry struct {
+	msg     []byte
+	ttls    []int
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache keeps answers for the lowest ttl found in them. Negative ones,
+// without answers, are kept as RFC 2308 says for the lower of the ttl and
+// the MINIMUM of their SOA record, or dnsNegativeTTL without one.
+type dnsCache struct {
+	sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]*dnsEntry)}
+}
+
+// get returns a copy of the cached answer for query, with its id and the
+// remaining ttls filled in.
+func (cache *dnsCache) get(key string, id []byte) []byte {
+	cache.Lock()
+	e, ok := cache.entries[key]
+	cache.Unlock()
+	now := time.Now()
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+
+	msg := append([]byte(nil), e.msg...)
+	copy(msg, id)
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, off := range e.ttls {
+		ttl := binary.BigEndian.Uint32(msg[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(msg[off:], ttl)
+	}
+	return msg
+}
+
+func (cache *dnsCache) put(msg []byte) {
+	m, err := parseDNS(msg)
+	if err != nil || m.trunc || (m.rcode != 0 && m.rcode != dnsRcodeNXDomain) {
+		return
+	}
+	ttl := m.minTTL
+	if m.answers == 0 {
+		ttl = m.negTTL
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	cache.Lock()
+	defer cache.Unlock()
+	if _, ok := cache.entries[m.key]; !ok && len(cache.entries) >= dnsCacheSize {
+		var oldest string
+		for k, e := range cache.entries {
+			if now.After(e.expires) {
+				delete(cache.entries, k)
+			} else if oldest == "" || e.stored.Before(cache.entries[oldest].stored) {
+				oldest = k
+			}
+		}
+		// nothing expired, the oldest answer makes room
+		if len(cache.entries) >= dnsCacheSize {
+			delete(cache.entries, oldest)
+		}
+	}
+	cache.entries[m.key] = &dnsEntry{
+		msg:     append([]byte(nil), msg...),
+		ttls:    m.ttls,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+func (c *muxConn) query(msg []byte) (n int, err error) {
+	n, err = c.send(c.id, flagQuery, msg)
+	return
+}
+
+func (client *Client) listenDNS() {
+	udpConn, err := net.ListenUDP("udp", (*net.UDPAddr)(client.DNSAddr))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	listener, err := net.ListenTCP("tcp", client.DNSAddr)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	log.Infof("DNS listening at %s", client.DNSAddr.String())
+
+	go client.serve(listener, client.handleDNS)
+
+	buf := make([]byte, dnsMaxSize)
+	for {
+		n, src, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			log.Infoln("dns conn ends with error: ", err)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			answer, err := client.resolve(query)
+			if err != nil {
+				log.Debug("dns query error: ", err)
+				return
+			}
+			_, _ = udpConn.WriteToUDP(answer, src)
+		}()
+	}
+}
+
+// handleDNS serves length prefixed queries over tcp.
+func (client *Client) handleDNS(conn *net.TCPConn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * dnsTimeout))
+		query, err := readDNS(r)
+		if err != nil {
+			return
+		}
+		answer, err := client.resolve(query)
+		if err != nil {
+			log.Debug("dns query error: ", err)
+			return
+		}
+		if err := writeDNS(conn, answer); err != nil {
+			return
+		}
+	}
+}
+
+// resolve answers query from the cache or through the server.
+func (client *Client) resolve(query []byte) ([]byte, error) {
+	m, err := parseDNS(query)
+	if err != nil {
+		return nil, err
+	}
+	if answer := client.dnsCache.get(m.key, query[:2]); answer != nil {
+		return answer, nil
+	}
+
+	c := createConn(nil)
+	_, err = c.query(query)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	// the server writes the answer and closes the stream
+	t := time.AfterFunc(dnsTimeout, func() { _ = c.Close() })
+	answer, err := ioutil.ReadAll(c)
+	t.Stop()
+	if err != nil || len(answer) < 12 {
+		return nil, errDNSFailed
+	}
+	client.dnsCache.put(answer)
+	return answer, nil
+}
+
+// lookupIP resolves host through the server for the IP rules.
+func (client *Client) lookupIP(host string) []net.IP {
+	results := make(chan []net.IP, 2)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func(qtype uint16) {
+			results <- client.queryIP(host, qtype)
+		}(qtype)
+	}
+	return append(<-results, <-results...)
+}
+
+func (client *Client) queryIP(host string, qtype uint16) []net.IP {
+	query, err := newDNSQuery(host, qtype)
+	if err != nil {
+		return nil
+	}
+	answer, err := client.resolve(query)
+	if err != nil {
+		log.Debugf("route lookup %s: %v", host, err)
+		return nil
+	}
+	m, err := parseDNS(answer)
+	if err != nil || m.rcode != 0 {
+		return nil
+	}
+	return m.ips
+}
+
+func (server *Server) dnsHandler(query []byte, c *muxConn) {
+	answer, err := server.DNS.forward(query)
+	if err != nil {
+		log.Warn("dns exchange error: ", err)
+		_ = c.Close()
+		return
+	}
+	_, _ = c.Write(answer)
+	_ = c.Close()
+}
+
+// exchangeDNS sends query to upstream over udp, and again over tcp when
+// the answer was truncated.
+func exchangeDNS(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray answers to other queries
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		if buf[2]&0x02 == 0 {
+			return buf[:n], nil
+		}
+		break
+	}
+
+	tcpConn, err := net.DialTimeout("tcp", upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	_ = tcpConn.SetDeadline(time.Now().Add(dnsTimeout))
+	if err = writeDNS(tcpConn, query); err != nil {
+		return nil, err
+	}
+	return readDNS(tcpConn)
+}
+
+func readDNS(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeDNS(w io.Writer, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf.
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
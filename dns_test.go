@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// buildDNS builds a query for example.com A, or an answer to it with one
+// compressed A record carrying ttl.
+func buildDNS(id uint16, answer bool, ttl uint32, trunc bool) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	msg = append(msg, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+	if !answer {
+		return msg
+	}
+	msg[2] = 0x80
+	if trunc {
+		msg[2] |= 0x02
+		return msg
+	}
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	rr := []byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4, 192, 0, 2, 1}
+	binary.BigEndian.PutUint32(rr[6:], ttl)
+	return append(msg, rr...)
+}
+
+// standInDNS answers on udp (truncated when trunc is set) and on tcp.
+func standInDNS(t *testing.T, trunc bool) string {
+	var udpConn *net.UDPConn
+	var listener *net.TCPListener
+	var addr *net.UDPAddr
+	// the tcp port matching the udp one may be taken, try another
+	for i := 0; listener == nil; i++ {
+		var err error
+		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = udpConn.LocalAddr().(*net.UDPAddr)
+		listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+		if err != nil {
+			_ = udpConn.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Cleanup(func() {
+		_ = udpConn.Close()
+		_ = listener.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, src, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			id := binary.BigEndian.Uint16(buf[:n])
+			_, _ = udpConn.WriteToUDP(buildDNS(id, true, 300, trunc), src)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			query, err := readDNS(conn)
+			if err == nil {
+				_ = writeDNS(conn, buildDNS(binary.BigEndian.Uint16(query), true, 300, false))
+			}
+			_ = conn.Close()
+		}
+	}()
+	return addr.String()
+}
+
+func TestExchangeDNS(t *testing.T) {
+	for _, trunc := range []bool{false, true} {
+		answer, err := exchangeDNS(standInDNS(t, trunc), buildDNS(0x1234, false, 0, false))
+		if err != nil {
+			t.Fatalf("trunc %v: %v", trunc, err)
+		}
+		m, err := parseDNS(answer)
+		if err != nil {
+			t.Fatalf("trunc %v: %v", trunc, err)
+		}
+		if m.trunc || len(m.ttls) != 1 || m.minTTL != 300 {
+			t.Fatalf("trunc %v: unexpected answer %+v", trunc, m)
+		}
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	cache := newDNSCache()
+	query, err := parseDNS(buildDNS(1, false, 0, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.put(buildDNS(1, true, 300, true))
+	if cache.get(query.key, []byte{0, 2}) != nil {
+		t.Fatal("truncated answer cached")
+	}
+	cache.put(buildDNS(1, true, 0, false))
+	if cache.get(query.key, []byte{0, 2}) != nil {
+		t.Fatal("answer with zero ttl cached")
+	}
+
+	cache.put(buildDNS(1, true, 300, false))
+	cache.entries[query.key].stored = time.Now().Add(-100 * time.Second)
+	answer := cache.get(query.key, []byte{0, 2})
+	if answer == nil {
+		t.Fatal("answer not cached")
+	}
+	if !bytes.Equal(answer[:2], []byte{0, 2}) {
+		t.Fatalf("id not rewritten: %x", answer[:2])
+	}
+	m, err := parseDNS(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.minTTL != 200 {
+		t.Fatalf("expect remaining ttl 200, got %d", m.minTTL)
+	}
+
+	cache.entries[query.key].expires = time.Now().Add(-time.Second)
+	if cache.get(query.key, []byte{0, 2}) != nil {
+		t.Fatal("expired answer returned")
+	}
+
+	// NXDOMAIN with an SOA of ttl 300 and MINIMUM 30 is kept for 30s
+	nx := buildDNS(1, false, 0, false)
+	nx[2], nx[3] = 0x80, dnsRcodeNXDomain
+	binary.BigEndian.PutUint16(nx[8:], 1)
+	soa := []byte{0xc0, 12, 0, dnsTypeSOA, 0, 1, 0, 0, 1, 44, 0, 22, 0, 0}
+	soa = append(soa, make([]byte, 20)...)
+	binary.BigEndian.PutUint32(soa[len(soa)-4:], 30)
+	cache.put(append(nx, soa...))
+	e, ok := cache.entries[query.key]
+	if !ok {
+		t.Fatal("negative answer not cached")
+	}
+	if ttl := e.expires.Sub(e.stored); ttl != 30*time.Second {
+		t.Fatalf("negative answer kept %v, want the SOA MINIMUM 30s", ttl)
+	}
+
+	// a full cache with nothing expired drops its oldest answer
+	cache = newDNSCache()
+	now := time.Now()
+	for i := 0; i < dnsCacheSize; i++ {
+		cache.entries[fmt.Sprint(i)] = &dnsEntry{
+			stored:  now.Add(time.Duration(i-dnsCacheSize) * time.Second),
+			expires: now.Add(time.Hour),
+		}
+	}
+	cache.put(buildDNS(1, true, 300, false))
+	if _, ok = cache.entries[query.key]; !ok || len(cache.entries) != dnsCacheSize {
+		t.Fatalf("answer not cached in a full cache, %d entries", len(cache.entries))
+	}
+	if _, ok = cache.entries["0"]; ok {
+		t.Error("oldest answer kept")
+	}
+}
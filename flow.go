@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Flow control of v2 websockets, after the WINDOW_UPDATE of HTTP/2. Each
+// direction of a stream, and each websocket as a whole, carries no more
+// data than its receiver granted. Both start out with initialWindow; the
+// receiver grants more with window frames as the destination drains what
+// it buffered, up to streamWindow per stream and wsWindow per websocket.
+// A window frame on stream 0 is for the websocket. v1 peers know nothing
+// of windows and are not flow controlled.
+const initialWindow = 64 * 1024
+
+var (
+	flagWindow = []byte("b")
+
+	streamWindow int64 = 256 * 1024
+	wsWindow     int64 = 4 * 1024 * 1024
+
+	wsStream = []byte{0, 0, 0, 0}
+)
+
+// setWindows sets the buffers granted to peers, in bytes.
+func setWindows(stream, ws int) error {
+	if stream < initialWindow || ws < initialWindow {
+		return fmt.Errorf("windows must be at least %d bytes", initialWindow)
+	}
+	streamWindow, wsWindow = int64(stream), int64(ws)
+	return nil
+}
+
+// window counts the data one direction of a stream or websocket carried
+// against what its receiver granted beyond initialWindow.
+type window struct {
+	granted int64
+	used    int64
+	read    int64 // receiver only
+}
+
+func (w *window) available() int64 {
+	return initialWindow + w.granted - w.used
+}
+
+// update grants the sender what the destination read, once that frees
+// half of size.
+func (w *window) update(size int64) uint32 {
+	inc := w.read + size - initialWindow - w.granted
+	if inc < size/2 {
+		return 0
+	}
+	w.granted += inc
+	return uint32(inc)
+}
+
+// flow guards the windows of a websocket and of the streams it carries.
+type flow struct {
+	sync.Mutex
+	cond       *sync.Cond
+	send, recv window
+	closed     bool
+}
+
+func newFlow() *flow {
+	f := new(flow)
+	f.cond = sync.NewCond(f)
+	return f
+}
+
+// acquire waits until the peer accepts data on c, then takes up to n bytes
+// off the stream and websocket windows.
+func (ws *webSocket) acquire(c *muxConn, n int) (int, error) {
+	f := ws.flow
+	f.Lock()
+	defer f.Unlock()
+	for {
+		if f.closed || c.closed {
+			return 0, ErrClosedPipe
+		}
+		avail := c.sendWin.available()
+		if a := f.send.available(); a < avail {
+			avail = a
+		}
+		if avail > 0 {
+			if int64(n) > avail {
+				n = int(avail)
+			}
+			c.sendWin.used += int64(n)
+			f.send.used += int64(n)
+			return n, nil
+		}
+		f.cond.Wait()
+	}
+}
+
+// received accounts n bytes arriving on c, or on a stream already gone if
+// c is nil, false if the peer overran a window.
+func (ws *webSocket) received(c *muxConn, n int) bool {
+	f := ws.flow
+	f.Lock()
+	defer f.Unlock()
+	f.recv.used += int64(n)
+	if c == nil {
+		return f.recv.available() >= 0
+	}
+	c.recvWin.used += int64(n)
+	return c.recvWin.available() >= 0 && f.recv.available() >= 0
+}
+
+// consumed accounts n bytes of c read by the destination, or dropped if c
+// is nil, and grants the peer room for more.
+func (ws *webSocket) consumed(c *muxConn, n int) {
+	var streamInc uint32
+	f := ws.flow
+	f.Lock()
+	f.recv.read += int64(n)
+	if c != nil && !c.closed {
+		c.recvWin.read += int64(n)
+		streamInc = c.recvWin.update(streamWindow)
+	}
+	wsInc := f.recv.update(wsWindow)
+	f.Unlock()
+
+	if streamInc > 0 {
+		_, _ = ws.writeData(c.id, flagWindow, windowPayload(streamInc))
+	}
+	if wsInc > 0 {
+		_, _ = ws.writeData(wsStream, flagWindow, windowPayload(wsInc))
+	}
+}
+
+// grant adds to the send window of c, or of the websocket if c is nil.
+func (ws *webSocket) grant(c *muxConn, inc uint32) {
+	f := ws.flow
+	f.Lock()
+	if c != nil {
+		c.sendWin.granted += int64(inc)
+	} else {
+		f.send.granted += int64(inc)
+	}
+	f.Unlock()
+	f.cond.Broadcast()
+}
+
+// release wakes writers of c, or of every stream if c is nil, to notice it
+// closed. Data c left unread no longer holds the websocket window.
+func (ws *webSocket) release(c *muxConn) {
+	var unread int64
+	f := ws.flow
+	f.Lock()
+	if c == nil {
+		f.closed = true
+	} else if !c.closed {
+		c.closed = true
+		unread = c.recvWin.used - c.recvWin.read
+	}
+	f.Unlock()
+	f.cond.Broadcast()
+	if unread > 0 && ws.version >= protocolV2 {
+		ws.consumed(nil, int(unread))
+	}
+}
+
+func windowPayload(inc uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, inc)
+	return b
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	var w window
+	w.used, w.read = initialWindow, initialWindow/4
+	if inc := w.update(initialWindow); inc != 0 {
+		t.Fatalf("update after a quarter read = %d, want 0", inc)
+	}
+	w.read = initialWindow / 2
+	if inc := w.update(initialWindow); inc != initialWindow/2 {
+		t.Fatalf("update after half read = %d, want %d", inc, initialWindow/2)
+	}
+	if a := w.available(); a != initialWindow/2 {
+		t.Fatalf("available = %d, want %d", a, initialWindow/2)
+	}
+	// a larger window is granted on the first read
+	w = window{used: 1, read: 1}
+	if inc := w.update(4 * initialWindow); inc != 3*initialWindow+1 {
+		t.Fatalf("first update = %d, want %d", inc, 3*initialWindow+1)
+	}
+
+	ws := &webSocket{flow: newFlow()}
+	c := &muxConn{ws: ws}
+	if n, err := ws.acquire(c, 2*initialWindow); err != nil || n != initialWindow {
+		t.Fatalf("acquire = %d, %v, want %d", n, err, initialWindow)
+	}
+	done := make(chan int)
+	go func() {
+		n, _ := ws.acquire(c, 100)
+		done <- n
+	}()
+	select {
+	case <-done:
+		t.Fatal("acquire returned on a full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ws.grant(c, 10)
+	select {
+	case <-done:
+		t.Fatal("acquire returned on a full websocket window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ws.grant(nil, 100)
+	if n := <-done; n != 10 {
+		t.Fatalf("acquire after grant = %d, want 10", n)
+	}
+	ws.release(c)
+	if _, err := ws.acquire(c, 1); err != ErrClosedPipe {
+		t.Fatalf("acquire on a closed stream = %v", err)
+	}
+}
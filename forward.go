@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Forward is a static local port forward, dialing a fixed destination
+// through the server for every accepted connection.
+type Forward struct {
+	Local  *net.TCPAddr
+	Remote Addr
+}
+
+// parseForward parses local_addr=remote_host:port.
+func parseForward(s string) (*Forward, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid forward %q, expect local_addr=remote_host:port", s)
+	}
+	local, err := net.ResolveTCPAddr("tcp", s[:i])
+	if err != nil {
+		return nil, err
+	}
+	remote := ParseAddr(s[i+1:])
+	if remote == nil {
+		return nil, fmt.Errorf("invalid forward destination %q", s[i+1:])
+	}
+	return &Forward{Local: local, Remote: remote}, nil
+}
+
+func (client *Client) listenForward(f *Forward) {
+	listener, err := net.ListenTCP("tcp", f.Local)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	log.Infof("Forwarding %s to %s", f.Local.String(), f.Remote.String())
+
+	client.serve(listener, func(tcpConn *net.TCPConn) {
+		client.forward(tcpConn, f.Remote)
+	})
+}
+
+// forward relays a connection accepted by a forward listener to remote.
+func (client *Client) forward(tcpConn *net.TCPConn, remote Addr) {
+	err := tcpConn.SetLinger(0)
+	if err != nil {
+		_ = tcpConn.Close()
+		return
+	}
+	conn := &bufConn{TCPConn: tcpConn, r: bufio.NewReader(tcpConn)}
+	client.connect(conn, remote, func(byte, Addr) error {
+		return nil
+	})
+}
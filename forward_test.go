@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEchoTCP echoes every connection accepted until the test ends,
+// returning its address.
+func startEchoTCP(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// ping writes a message on conn and expects it back.
+func ping(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo %q %v", buf, err)
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	f, err := parseForward("127.0.0.1:8080=example.com:80")
+	if err != nil || f.Local.Port != 8080 || f.Remote.String() != "example.com:80" {
+		t.Errorf("got %+v %v", f, err)
+	}
+	for _, s := range []string{"127.0.0.1:8080", "127.0.0.1:8080=example.com", "nohost=example.com:80"} {
+		if _, err = parseForward(s); err == nil {
+			t.Errorf("%s: accepted", s)
+		}
+	}
+}
+
+// TestForward relays a connection accepted by a -L listener to its fixed
+// destination through the mux.
+func TestForward(t *testing.T) {
+	startServer(t)
+	f, err := parseForward("127.0.0.1:0=" + startEchoTCP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.ListenTCP("tcp", f.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client := new(Client)
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go client.forward(conn, f.Remote)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ping(t, conn)
+}
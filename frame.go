@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Frames of the mux. Protocol v1, spoken with peers that negotiate
+// nothing, carries one frame per websocket message:
+//
+//	stream id(4) | flag(1, ASCII) | payload | hash(8)
+//
+// the hash covering the payload. Protocol v2 is agreed on at upgrade time
+// through Sec-WebSocket-Protocol and carries one or more frames per
+// message, followed by a single hash covering all of them:
+//
+//	version(1) | type(1) | flags(2) | stream id(4) | length(4) | payload
+//
+// Integers are big endian, the stream id is copied as is. The type is the
+// v1 flag read as a hex digit, so '0' (dial) is 0 and 'a' (query) is 10;
+// types without a v1 flag are only sent on v2 websockets. Receivers ignore
+// flags they do not know.
+const (
+	protocolV1 = 1
+	protocolV2 = 2
+
+	subprotocolV2  = "wssocks.v2"
+	frameHeaderLen = 12
+
+	// frameNoDelay marks dial and loop frames of latency sensitive streams,
+	// whose frames the peer then sends without coalescing.
+	frameNoDelay uint16 = 1
+)
+
+var (
+	errFrame     = errors.New("illegal frame")
+	errFrameHash = errors.New("invalid hash")
+)
+
+const frameFlags = "0123456789abcdef"
+
+// frameType maps a v1 flag to its v2 type.
+func frameType(flag []byte) byte {
+	for i := 0; i < len(frameFlags); i++ {
+		if frameFlags[i] == flag[0] {
+			return byte(i)
+		}
+	}
+	return 0xff
+}
+
+// frameFlag maps a v2 type to the flag dispatched on, nil if unknown.
+func frameFlag(typ byte) []byte {
+	if int(typ) >= len(frameFlags) {
+		return nil
+	}
+	return []byte{frameFlags[typ]}
+}
+
+// appendFrame appends a v2 frame to b.
+func appendFrame(b, id, flag []byte, flags uint16, p []byte) []byte {
+	var h [frameHeaderLen]byte
+	h[0], h[1] = protocolV2, frameType(flag)
+	binary.BigEndian.PutUint16(h[2:], flags)
+	copy(h[4:8], id)
+	binary.BigEndian.PutUint32(h[8:], uint32(len(p)))
+	return append(append(b, h[:]...), p...)
+}
+
+// splitFrame cuts the first v2 frame off b.
+func splitFrame(b []byte) (id, flag []byte, flags uint16, p, rest []byte, err error) {
+	if len(b) < frameHeaderLen || b[0] != protocolV2 {
+		return nil, nil, 0, nil, nil, errFrame
+	}
+	n := binary.BigEndian.Uint32(b[8:])
+	if uint64(n) > uint64(len(b)-frameHeaderLen) {
+		return nil, nil, 0, nil, nil, errFrame
+	}
+	end := frameHeaderLen + int(n)
+	return b[4:8], frameFlag(b[1]), binary.BigEndian.Uint16(b[2:]), b[frameHeaderLen:end], b[end:], nil
+}
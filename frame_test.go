@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"github.com/panjf2000/ants/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrame(t *testing.T) {
+	b := appendFrame(nil, []byte{1, 2, 3, 4}, flagQuery, 0x8001, []byte("abc"))
+	b = appendFrame(b, []byte{5, 6, 7, 8}, flagClose, 0, nil)
+	if len(b) != 2*frameHeaderLen+3 || b[1] != 10 {
+		t.Fatalf("unexpected encoding %x", b)
+	}
+	id, flag, flags, p, rest, err := splitFrame(b)
+	if err != nil || !bytes.Equal(id, []byte{1, 2, 3, 4}) || !bytes.Equal(flag, flagQuery) ||
+		flags != 0x8001 || string(p) != "abc" {
+		t.Fatalf("unexpected first frame %x %s %x %q %v", id, flag, flags, p, err)
+	}
+	id, flag, _, p, rest, err = splitFrame(rest)
+	if err != nil || !bytes.Equal(id, []byte{5, 6, 7, 8}) || !bytes.Equal(flag, flagClose) || len(p) != 0 || len(rest) != 0 {
+		t.Fatalf("unexpected second frame %x %s %q %v", id, flag, p, err)
+	}
+	for _, bad := range [][]byte{b[:frameHeaderLen+2], {1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, b[:5]} {
+		if _, _, _, _, _, err := splitFrame(bad); err != errFrame {
+			t.Errorf("%x: expect errFrame, got %v", bad, err)
+		}
+	}
+}
+
+// startServer serves websockets for the test and points the client at
+// them, through a single websocket key, until the test ends.
+func startServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	thread, pool, keys, n := mainThread, serverPool, wsKeys, wsLen
+	if mainThread == nil {
+		mainThread, _ = ants.NewPool(100)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	t.Cleanup(func() {
+		for _, k := range wsKeys {
+			if v, ok := wsPool.Load(u64(k)); ok {
+				v.(*webSocket).close()
+			}
+		}
+		srv.Close()
+		if thread == nil {
+			mainThread.Release()
+		}
+		mainThread, serverPool, wsKeys, wsLen = thread, pool, keys, n
+	})
+	var err error
+	serverPool, err = parseUpstreams([]string{"ws" + strings.TrimPrefix(srv.URL, "http")}, balanceRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsKeys, wsLen = [][]byte{genRandBytes(wsAddrLen)}, 1
+	return srv
+}
+
+// TestWireVersions sends a loop frame, which the server answers with a
+// close frame, for each protocol the client may offer.
+func TestWireVersions(t *testing.T) {
+	startServer(t)
+	var err error
+	defer func(v int) { wireVersion = v }(wireVersion)
+
+	for _, v := range []int{protocolV1, protocolV2} {
+		wireVersion = v
+		ws := startWs(genRandBytes(wsAddrLen))
+		if ws.version != v {
+			t.Errorf("offered %d, agreed on %d", v, ws.version)
+		}
+		c := &muxConn{
+			ws:   ws,
+			done: make(chan struct{}),
+		}
+		ws.openStream(c)
+		if _, err = c.bench([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-c.done:
+		case <-time.After(time.Second):
+			t.Errorf("v%d: no close frame back", v)
+		}
+		ws.close()
+	}
+}
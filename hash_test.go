@@ -24,7 +24,7 @@ func BenchmarkHash(b *testing.B) {
 		b.Run(fmt.Sprintf("MurMur64-%v-%d", flagMurMurHash, grs), BenchmarkMurMur64)
 		b.Run(fmt.Sprintf("Adler32-%v-%d", flagAdlerHash, grs), BenchmarkAdler32)
 		b.Run(fmt.Sprintf("Crc32-%v-%d", flagCRCHash, grs), BenchmarkCrc32)
-		b.Run(fmt.Sprintf("xxHash64-%v-%d", flagXXHash, grs), BenchmarkxxHash64)
+		b.Run(fmt.Sprintf("xxHash64-%v-%d", flagXXHash, grs), BenchmarkXXHash64)
 		fmt.Println()
 	}
 }
@@ -69,7 +69,7 @@ func BenchmarkCrc32(b *testing.B) {
 	//print(len(crcHash(testBytes, 0)))
 }
 
-func BenchmarkxxHash64(b *testing.B) {
+func BenchmarkXXHash64(b *testing.B) {
 	b.SetBytes(grs)
 	b.ResetTimer()
 
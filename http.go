@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are consumed by the proxy and never forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// handleHTTP serves CONNECT and absolute-URI requests. Plain requests are
+// forwarded one per connection with "Connection: close", their body is
+// streamed untouched behind the rewritten head.
+func (client *Client) handleHTTP(conn *bufConn) {
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	if client.Auth != nil && !client.proxyAuth(req) {
+		log.Warnf("http proxy authentication failed from %v", conn.RemoteAddr())
+		rejectHTTP(conn, http.StatusProxyAuthRequired,
+			"Proxy-Authenticate: Basic realm=\"wsSocks\"\r\n")
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		addr := ParseAddr(hostPort(req.Host, "443"))
+		if addr == nil {
+			rejectHTTP(conn, http.StatusBadRequest, "")
+			return
+		}
+		log.Debugln(addr.String())
+		client.connect(conn, addr, func(rep byte, _ Addr) error {
+			if rep != 0 {
+				return writeStatus(conn, httpStatus(rep), "")
+			}
+			_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			return err
+		})
+		return
+	}
+
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		rejectHTTP(conn, http.StatusBadRequest, "")
+		return
+	}
+	addr := ParseAddr(hostPort(req.URL.Host, "80"))
+	if addr == nil {
+		rejectHTTP(conn, http.StatusBadRequest, "")
+		return
+	}
+	log.Debugln(addr.String())
+
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Connection", "close")
+	// framed below from the parsed request, not to be sent twice
+	req.Header.Del("Content-Length")
+
+	head := new(bytes.Buffer)
+	_, _ = fmt.Fprintf(head, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	if len(req.TransferEncoding) > 0 {
+		_, _ = fmt.Fprintf(head, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", "))
+	} else if req.ContentLength > 0 {
+		_, _ = fmt.Fprintf(head, "Content-Length: %d\r\n", req.ContentLength)
+	}
+	_ = req.Header.Write(head)
+	head.WriteString("\r\n")
+
+	// the body is still unread in conn.r, put the new head in front of it
+	conn.r = bufio.NewReader(io.MultiReader(head, conn.r))
+	client.connect(conn, addr, func(rep byte, _ Addr) error {
+		if rep != 0 {
+			return writeStatus(conn, httpStatus(rep), "")
+		}
+		return nil
+	})
+}
+
+func (client *Client) proxyAuth(req *http.Request) bool {
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+	if err != nil {
+		return false
+	}
+	i := bytes.IndexByte(b, ':')
+	if i < 0 {
+		return false
+	}
+	return client.Auth.Validate(string(b[:i]), string(b[i+1:]))
+}
+
+// hostPort appends port to host unless it already carries one.
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// httpStatus maps a SOCKS reply code to the closest proxy status.
+func httpStatus(rep byte) int {
+	switch Error(rep) {
+	case ErrConnectionNotAllowed:
+		return http.StatusForbidden
+	case ErrTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// writeStatus writes a bodyless response ending the connection.
+func writeStatus(w io.Writer, code int, header string) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n",
+		code, http.StatusText(code), header)
+	return err
+}
+
+func rejectHTTP(conn *bufConn, code int, header string) {
+	_ = writeStatus(conn, code, header)
+	_ = conn.SetLinger(-1)
+	_ = conn.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestHTTPForward posts a body through the proxy to an origin that sees
+// the request head as sent.
+func TestHTTPForward(t *testing.T) {
+	startServer(t)
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	heads := make(chan string, 1)
+	go func() {
+		conn, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var head strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			head.WriteString(line)
+			if line == "\r\n" {
+				break
+			}
+		}
+		heads <- head.String()
+		body := make([]byte, len("hello"))
+		_, _ = io.ReadFull(r, body)
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	}()
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go func() {
+		conn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		tcpConn := conn.(*net.TCPConn)
+		new(Client).handleHTTP(&bufConn{TCPConn: tcpConn, r: bufio.NewReader(tcpConn)})
+	}()
+
+	proxyURL, _ := url.Parse("http://" + proxy.Addr().String())
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := hc.Post("http://"+origin.Addr().String()+"/post", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("got %v %q, want 200 and the body back", resp.Status, body)
+	}
+	head := <-heads
+	if n := strings.Count(strings.ToLower(head), "\ncontent-length:"); n != 1 {
+		t.Errorf("origin got %d Content-Length headers:\n%s", n, head)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Websockets are kept alive with websocket pings, which every peer answers,
+// earlier versions included. One that shows no sign of life for
+// keepaliveTimeout is closed and counted as a failure of its server, and
+// the client dials a replacement right away instead of when a stream next
+// needs it. Pongs carry the time their ping was sent, giving the smoothed
+// rtt of each websocket, as TCP's SRTT of RFC 6298.
+var (
+	keepaliveInterval = 15 * time.Second
+	keepaliveTimeout  = 45 * time.Second
+)
+
+// setKeepalive sets how often websockets are pinged and how long they may
+// stay silent, 0 disables either.
+func setKeepalive(interval, timeout time.Duration) error {
+	if interval > 0 && timeout > 0 && timeout <= interval {
+		return fmt.Errorf("keepalive timeout %v must exceed the interval %v", timeout, interval)
+	}
+	keepaliveInterval, keepaliveTimeout = interval, timeout
+	return nil
+}
+
+// startKeepalive must run before the reader of ws starts.
+func (ws *webSocket) startKeepalive() {
+	ws.timeout = keepaliveTimeout
+	ws.conn.SetPongHandler(func(data string) error {
+		if len(data) == 8 {
+			sent := int64(binary.BigEndian.Uint64([]byte(data)))
+			ws.sample(time.Duration(time.Now().UnixNano() - sent))
+		}
+		ws.alive()
+		return nil
+	})
+	ws.alive()
+	if keepaliveInterval > 0 {
+		go ws.ping(ws.conn, keepaliveInterval)
+	}
+}
+
+// ping runs until conn closes and writing fails.
+func (ws *webSocket) ping(conn *wsConn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+		if err := conn.WriteControl(websocket.PingMessage, b, time.Now().Add(interval)); err != nil {
+			log.Debugf("websocket %v ping: %v", u64(ws.id), err)
+			return
+		}
+	}
+}
+
+// alive pushes the read deadline of ws back, called from its reader.
+func (ws *webSocket) alive() {
+	if ws.timeout > 0 {
+		_ = ws.conn.SetReadDeadline(time.Now().Add(ws.timeout))
+	}
+}
+
+// sample folds rtt into the smoothed rtt of ws, called from its reader.
+func (ws *webSocket) sample(rtt time.Duration) {
+	srtt := ws.RTT()
+	if srtt == 0 {
+		srtt = rtt
+	} else {
+		srtt += (rtt - srtt) / 8
+	}
+	atomic.StoreInt64(&ws.srtt, int64(srtt))
+	log.Debugf("websocket %v rtt %v, smoothed %v", u64(ws.id), rtt, srtt)
+	if ws.server != nil {
+		serverPool.measured(ws.server, srtt)
+	}
+}
+
+// unresponsive tells whether the reader of ws stopped on err because the
+// keepalive timed out, reporting that against its server.
+func (ws *webSocket) unresponsive(err error) bool {
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		return false
+	}
+	if ws.server != nil {
+		serverPool.report(ws.server, err)
+	}
+	return true
+}
+
+// RTT returns the smoothed rtt of ws, 0 until measured.
+func (ws *webSocket) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&ws.srtt))
+}
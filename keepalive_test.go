@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepalive(t *testing.T) {
+	if err := setKeepalive(time.Second, time.Second); err == nil {
+		t.Error("timeout equal to the interval accepted")
+	}
+	startServer(t)
+	defer func(i, d time.Duration) { keepaliveInterval, keepaliveTimeout = i, d }(keepaliveInterval, keepaliveTimeout)
+	if err := setKeepalive(10*time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := startWs(genRandBytes(wsAddrLen))
+	defer ws.close()
+	for deadline := time.Now().Add(time.Second); ws.RTT() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no rtt measured")
+		}
+	}
+	serverPool.Lock()
+	defer serverPool.Unlock()
+	if serverPool.list[0].rtt == 0 {
+		t.Error("rtt not reported to the server pool")
+	}
+}
+
+// TestWriteStalled fails a write to a peer that stopped reading once the
+// keepalive timeout passed, rather than blocking the websocket for good.
+func TestWriteStalled(t *testing.T) {
+	defer func(d time.Duration) { keepaliveTimeout = d }(keepaliveTimeout)
+	keepaliveTimeout = 100 * time.Millisecond
+	stop := make(chan struct{})
+	defer close(stop)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := new(websocket.Upgrader).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-stop
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := &wsConn{conn}
+	frames := make([]byte, 1<<20)
+	noHash := func([]byte, uint64) []byte { return nil }
+	start := time.Now()
+	for time.Since(start) < 10*time.Second {
+		if err = c.writeFrames(frames, noHash); err != nil {
+			break
+		}
+	}
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Fatalf("expect a write timeout, got %v", err)
+	}
+}
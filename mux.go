@@ -1,19 +1,38 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"math/rand"
 	"net"
 	"sync"
+	"time"
 )
 
 type muxConn struct {
 	io.ReadWriter
-	pipeW *PipeWriter
-	pipeR *PipeReader
-	conn  net.Conn
-	id    []byte
-	ws    *webSocket
+	pipeW   *PipeWriter
+	pipeR   *PipeReader
+	conn    net.Conn
+	ln      net.Listener
+	udp     *udpAssoc
+	target  string
+	remote  Addr // destination the server reached, client only
+	id      []byte
+	ws      *webSocket
+	replies chan []byte
+	done    chan struct{}
+	once    sync.Once
+	fin     bool // the peer is done writing
+	noDelay bool // latency sensitive, frames skip coalescing
+
+	// conn may be attached while the reader ends the stream
+	connLock sync.Mutex
+	ended    bool
+
+	// flow control, guarded by ws.flow
+	sendWin, recvWin window
+	closed           bool
 }
 
 type wPool struct {
@@ -21,19 +40,34 @@ type wPool struct {
 }
 
 var (
-	wsPool   = new(wPool)
-	connPool = new(sync.Map)
+	wsPool = new(wPool)
+
+	errReplyTimeout = errors.New("timeout waiting for reply")
 )
 
+// replyTimeout bounds how long the client waits for a dial result.
+const replyTimeout = 30 * time.Second
+
+// getWs picks two websockets at random and returns the one with the lower
+// rtt, a new one until it is measured.
 func (c *wPool) getWs() (ws *webSocket) {
-	id := wsKeys[rand.Intn(wsLen)]
+	ws = c.get(wsKeys[rand.Intn(wsLen)])
+	if s, ok := c.Load(u64(wsKeys[rand.Intn(wsLen)])); ok {
+		if other := s.(*webSocket); !other.isClosed() && other.RTT() > 0 && other.RTT() < ws.RTT() {
+			return other
+		}
+	}
+	return
+}
+
+func (c *wPool) get(id []byte) (ws *webSocket) {
 	if s, ok := c.Load(u64(id)); !ok {
 		ws = startWs(id)
 		c.Store(u64(id), ws)
 		return
 	} else {
 		ws = s.(*webSocket)
-		if ws.closed {
+		if ws.isClosed() {
 			ws = startWs(id)
 			c.Store(u64(id), ws)
 		}
@@ -41,46 +75,198 @@ func (c *wPool) getWs() (ws *webSocket) {
 	}
 }
 
+// retire replaces ws for new streams, it closes once its own are done.
+func (c *wPool) retire(ws *webSocket) {
+	ws.streamLock.Lock()
+	ws.retired = true
+	idle := len(ws.streams) == 0
+	ws.streamLock.Unlock()
+	c.remove(ws)
+	if idle {
+		_ = ws.conn.Close()
+	}
+}
+
+// replace dials a new websocket in place of ws, unless that happened
+// already.
+func (c *wPool) replace(ws *webSocket) {
+	if s, ok := c.Load(u64(ws.id)); ok && s != ws {
+		return
+	}
+	c.Store(u64(ws.id), startWs(ws.id))
+}
+
+// remove drops ws unless it was replaced already.
+func (c *wPool) remove(ws *webSocket) {
+	if v, ok := c.Load(u64(ws.id)); ok && v == ws {
+		c.Delete(u64(ws.id))
+	}
+}
+
 func createConn(conn net.Conn) (c *muxConn) {
 	c = &muxConn{
-		id:   genRandBytes(connAddrLen),
-		conn: conn,
-		ws:   wsPool.getWs(),
+		conn:    conn,
+		replies: make(chan []byte, 2),
+		done:    make(chan struct{}),
 	}
 	c.pipeR, c.pipeW = newPipe()
-	connPool.Store(u32(c.id), c)
-	return
+	for {
+		c.ws = wsPool.getWs()
+		if c.ws.openStream(c) {
+			return
+		}
+		// out of stream ids, later streams go to a new websocket
+		wsPool.retire(c.ws)
+	}
 }
 
 func (c *muxConn) dial(host Addr) (n int, err error) {
-	n, err = c.send(c.id, flagDial, []byte(host.String()))
+	n, err = c.ws.writeFrame(c.id, flagDial, c.frameFlags(), []byte(host.String()), false)
 	return
 }
 
+func (c *muxConn) bind(host Addr) (n int, err error) {
+	n, err = c.send(c.id, flagBind, []byte(host.String()))
+	return
+}
+
+// reply reports the outcome of a server side operation to the client,
+// as a SOCKS reply code and bound address.
+func (c *muxConn) reply(rep byte, bnd Addr) (n int, err error) {
+	n, err = c.send(c.id, flagReply, append([]byte{rep}, bnd...))
+	return
+}
+
+// waitReply blocks until the server replies, the stream closes or timeout.
+func (c *muxConn) waitReply(timeout time.Duration) (rep byte, bnd Addr, err error) {
+	var r []byte
+	select {
+	case r = <-c.replies:
+	case <-c.done:
+		// a reply may be queued right before the close frame
+		select {
+		case r = <-c.replies:
+		default:
+			return 0, nil, ErrClosedPipe
+		}
+	case <-time.After(timeout):
+		return 0, nil, errReplyTimeout
+	}
+	if len(r) < 1 {
+		return 0, nil, ErrGeneralFailure
+	}
+	bnd = SplitAddr(r[1:])
+	if bnd != nil {
+		c.remote = SplitAddr(r[1+len(bnd):])
+	}
+	return r[0], bnd, nil
+}
+
+// attach gives the stream the connection it carries, false if the stream
+// ended meanwhile and the caller is left to close conn.
+func (c *muxConn) attach(conn net.Conn) bool {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.ended {
+		return false
+	}
+	c.conn = conn
+	return true
+}
+
+// localConn returns the connection attached, if any.
+func (c *muxConn) localConn() net.Conn {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	return c.conn
+}
+
 func (c *muxConn) closeStuff() {
-	if c.conn != nil {
-		_ = c.conn.Close()
+	if c.done != nil {
+		c.once.Do(func() { close(c.done) })
+	}
+	c.connLock.Lock()
+	c.ended = true
+	conn := c.conn
+	c.connLock.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+	if c.ln != nil {
+		_ = c.ln.Close()
+	}
+	if c.udp != nil {
+		_ = c.udp.conn.Close()
 	}
 	if c.pipeR != nil {
 		_ = c.pipeW.Close()
 		_ = c.pipeR.Close()
 	}
+	if c.ws != nil {
+		c.ws.release(c)
+	}
+}
+
+// finish ends a stream the peer closed after FIN: what it sent still
+// reaches the destination, the stream is closed once that is done.
+func (c *muxConn) finish() {
+	if c.ws != nil {
+		c.ws.release(c)
+	}
+	_ = c.pipeW.Close()
+	// unblock a read on the destination that would keep it waiting
+	_ = c.localConn().SetReadDeadline(time.Now())
 }
 
 func (c *muxConn) Close() (err error) {
-	connPool.Delete(u32(c.id))
+	c.ws.removeStream(c)
 	c.closeStuff()
 	_, err = c.send(c.id, flagClose, nil)
 	return
 }
 
+// CloseWrite tells the peer no more data follows, leaving the other
+// direction open. v1 has no such frame, streams only end with Close there.
+func (c *muxConn) CloseWrite() (err error) {
+	if c.ws.version < protocolV2 {
+		return
+	}
+	_, err = c.send(c.id, flagFin, nil)
+	return
+}
+
+// Read returns data sent by the peer, granting it room for more.
+func (c *muxConn) Read(p []byte) (n int, err error) {
+	n, err = c.pipeR.Read(p)
+	if n > 0 && c.ws.version >= protocolV2 {
+		c.ws.consumed(c, n)
+	}
+	return
+}
+
+// Write sends p as data frames, waiting for the peer to grant room on v2
+// websockets. Unless c is latency sensitive they may be coalesced, so Write
+// can return before they are sent.
 func (c *muxConn) Write(p []byte) (n int, err error) {
-	n, err = c.send(c.id, flagData, p)
+	if c.ws.version < protocolV2 {
+		return c.send(c.id, flagData, p)
+	}
+	for len(p) > 0 {
+		var m int
+		if m, err = c.ws.acquire(c, len(p)); err != nil {
+			return
+		}
+		if _, err = c.ws.writeFrame(c.id, flagData, 0, p[:m], !c.noDelay); err != nil {
+			return
+		}
+		n += m
+		p = p[m:]
+	}
 	return
 }
 
 func (c *muxConn) bench(p []byte) (n int, err error) {
-	n, err = c.send(c.id, flagLoop, p)
+	n, err = c.ws.writeFrame(c.id, flagLoop, c.frameFlags(), p, !c.noDelay)
 	return
 }
 
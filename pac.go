@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// pacScript renders the rules as a PAC file. Rules are emitted in order up
+// to the first one a browser can not evaluate (ports, GEOIP, ASN, IPv6
+// CIDR, regular expressions, whose Go syntax JavaScript reads differently);
+// from there on everything goes to proxyAddr, where the client
+// applies the complete rules itself.
+func (router *Router) pacScript(proxyAddr string) []byte {
+	proxy := fmt.Sprintf("SOCKS5 %s; SOCKS %s", proxyAddr, proxyAddr)
+	result := func(a Action) string {
+		if a == ActionDirect {
+			return "DIRECT"
+		}
+		// rejects are enforced by the client
+		return proxy
+	}
+	str := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("// generated by wsSocks\n")
+	buf.WriteString("function FindProxyForURL(url, host) {\n")
+	buf.WriteString("\thost = host.toLowerCase().replace(/\\.$/, \"\");\n")
+	buf.WriteString("\tvar ip = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n")
+
+	router.RLock()
+	defer router.RUnlock()
+	final := result(router.final)
+	for _, ru := range router.rules {
+		var cond string
+		switch ru.kind {
+		case "DOMAIN":
+			cond = fmt.Sprintf("host == %s", str(ru.value))
+		case "DOMAIN-SUFFIX":
+			cond = fmt.Sprintf("dnsDomainIs(host, %s) || host == %s", str("."+ru.value), str(ru.value))
+		case "DOMAIN-KEYWORD":
+			cond = fmt.Sprintf("host.indexOf(%s) >= 0", str(ru.value))
+		case "IP-CIDR":
+			ip4 := ru.ipNet.IP.To4()
+			if ip4 == nil {
+				break
+			}
+			mask := net.IP(ru.ipNet.Mask).String()
+			if ru.resolve {
+				cond = fmt.Sprintf("isInNet(host, %s, %s)", str(ip4.String()), str(mask))
+			} else {
+				cond = fmt.Sprintf("ip && isInNet(host, %s, %s)", str(ip4.String()), str(mask))
+			}
+		}
+		if cond == "" {
+			final = proxy
+			break
+		}
+		_, _ = fmt.Fprintf(buf, "\tif (%s) return %s;\n", cond, str(result(ru.action)))
+	}
+	_, _ = fmt.Fprintf(buf, "\treturn %s;\n}\n", str(final))
+	return buf.Bytes()
+}
+
+func (client *Client) listenPAC() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// point browsers at the host they fetched the script from
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if ip := client.ListenTCPAddr.IP; ip != nil && !ip.IsUnspecified() {
+			host = ip.String()
+		}
+		proxyAddr := net.JoinHostPort(host, strconv.Itoa(client.ListenTCPAddr.Port))
+
+		router := client.Router
+		if router == nil {
+			router = new(Router)
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write(router.pacScript(proxyAddr))
+	})
+
+	log.Infof("PAC listening at http://%s/proxy.pac", client.PACAddr)
+	err := http.ListenAndServe(client.PACAddr, mux)
+	if err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPACScript(t *testing.T) {
+	router, err := parseRules(strings.NewReader(`DOMAIN,exact.example.org,direct
+DOMAIN-SUFFIX,corp.example,direct
+DOMAIN-KEYWORD,tracker,reject
+IP-CIDR,10.0.0.0/8,direct,no-resolve
+DOMAIN-REGEX,(?i)^ads?\.,direct
+DOMAIN,after.example,direct
+FINAL,direct
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := string(router.pacScript("127.0.0.1:1080"))
+
+	for _, want := range []string{
+		`if (host == "exact.example.org") return "DIRECT";`,
+		`if (dnsDomainIs(host, ".corp.example") || host == "corp.example") return "DIRECT";`,
+		`if (host.indexOf("tracker") >= 0) return "SOCKS5 127.0.0.1:1080; SOCKS 127.0.0.1:1080";`,
+		`if (ip && isInNet(host, "10.0.0.0", "255.0.0.0")) return "DIRECT";`,
+		// the regex and what follows it are left to the client
+		`return "SOCKS5 127.0.0.1:1080; SOCKS 127.0.0.1:1080";
+}`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("missing %s in\n%s", want, script)
+		}
+	}
+	for _, unwanted := range []string{"RegExp", "after.example", `return "DIRECT";
+}`} {
+		if strings.Contains(script, unwanted) {
+			t.Errorf("unexpected %s in\n%s", unwanted, script)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// privateNets are refused by the deny-private preset: loopback, link-local,
+// private, shared, multicast and reserved ranges, and the local use NAT64
+// prefix. IPv6 addresses embedding an IPv4 one are checked against both,
+// see embeddedIPv4.
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b:1::/48", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// embeddingNets carry an IPv4 address in their last 32 bits: NAT64
+// (RFC 6052), IPv4-mapped, IPv4-translated (RFC 2765) and the deprecated
+// IPv4-compatible form.
+var embeddingNets = mustParseCIDRs("64:ff9b::/96", "::ffff:0:0/96", "::ffff:0:0:0/96", "::/96")
+
+// 6to4 (RFC 3056) puts the IPv4 address of the site right after the
+// prefix, Teredo (RFC 4380) that of the client last, inverted.
+var (
+	sixToFourNet = mustParseCIDRs("2002::/16")[0]
+	teredoNet    = mustParseCIDRs("2001::/32")[0]
+)
+
+// Policy decides which destinations the server dials for its clients.
+// Explicitly allowed networks win over denied ones, which win over the
+// deny-private preset. Domain patterns and ports are checked before
+// resolving, networks against the resolved address that is dialed, so
+// that rebinding a name can not get around them.
+type Policy struct {
+	AllowNets    []*net.IPNet
+	DenyNets     []*net.IPNet
+	AllowPorts   []portRange
+	AllowDomains []string
+	DenyDomains  []string
+	DenyPrivate  bool
+}
+
+func mustParseCIDRs(list ...string) []*net.IPNet {
+	nets, err := parseCIDRs(list)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func parseCIDRs(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func lowerAll(list []string) []string {
+	for i := range list {
+		list[i] = strings.ToLower(strings.TrimSuffix(list[i], "."))
+	}
+	return list
+}
+
+// matchDomain matches host against a glob like *.example.com, or else
+// against the domain itself and its subdomains.
+func matchDomain(pattern, host string) bool {
+	if strings.Contains(pattern, "*") {
+		ok, _ := path.Match(pattern, host)
+		return ok
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// embeddedIPv4 returns the IPv4 address an IPv6 one reaches it through,
+// nil for any other address.
+func embeddedIPv4(ip net.IP) net.IP {
+	if len(ip) != net.IPv6len || ip.Equal(net.IPv6unspecified) || ip.Equal(net.IPv6loopback) {
+		return nil
+	}
+	for _, n := range embeddingNets {
+		if n.Contains(ip) {
+			return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+		}
+	}
+	switch {
+	case sixToFourNet.Contains(ip):
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5])
+	case teredoNet.Contains(ip):
+		return net.IPv4(^ip[12], ^ip[13], ^ip[14], ^ip[15])
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// checkHost checks the destination as requested, before resolving it.
+func (p *Policy) checkHost(host string, port int) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.AllowPorts) > 0 {
+		allowed := false
+		for _, r := range p.AllowPorts {
+			allowed = allowed || port >= r.lo && port <= r.hi
+		}
+		if !allowed {
+			return fmt.Errorf("port %d not allowed: %w", port, ErrConnectionNotAllowed)
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.DenyDomains {
+		if matchDomain(pattern, host) {
+			return fmt.Errorf("domain %s denied by %s: %w", host, pattern, ErrConnectionNotAllowed)
+		}
+	}
+	if len(p.AllowDomains) == 0 {
+		return nil
+	}
+	for _, pattern := range p.AllowDomains {
+		if matchDomain(pattern, host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("domain %s not allowed: %w", host, ErrConnectionNotAllowed)
+}
+
+// checksNets tells whether addresses are checked, names then have to be
+// resolved before dialing.
+func (p *Policy) checksNets() bool {
+	return p != nil && (p.DenyPrivate || len(p.DenyNets) > 0)
+}
+
+// checkIP checks the resolved address about to be dialed, and the IPv4
+// address it embeds if any.
+func (p *Policy) checkIP(ip net.IP) error {
+	if p == nil {
+		return nil
+	}
+	if containsIP(p.AllowNets, ip) != nil {
+		return nil
+	}
+	addrs := []net.IP{ip}
+	if v4 := embeddedIPv4(ip); v4 != nil {
+		addrs = append(addrs, v4)
+	}
+	for _, a := range addrs {
+		if n := containsIP(p.DenyNets, a); n != nil {
+			return fmt.Errorf("address %v denied by %v: %w", ip, n, ErrConnectionNotAllowed)
+		}
+		if !p.DenyPrivate {
+			continue
+		}
+		if n := containsIP(privateNets, a); n != nil {
+			return fmt.Errorf("address %v is private (%v): %w", ip, n, ErrConnectionNotAllowed)
+		}
+	}
+	return nil
+}
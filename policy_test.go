@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	p := &Policy{
+		AllowNets:   mustParseCIDRs("10.1.0.0/16"),
+		DenyNets:    mustParseCIDRs("203.0.113.7"),
+		AllowPorts:  []portRange{{80, 80}, {443, 443}},
+		DenyDomains: []string{"internal.example", "*.ads.example"},
+		DenyPrivate: true,
+	}
+
+	hosts := []struct {
+		host string
+		port int
+		ok   bool
+	}{
+		{"example.com", 443, true},
+		{"example.com", 22, false},
+		{"internal.example", 80, false},
+		{"git.internal.example", 80, false},
+		{"notinternal.example", 80, true},
+		{"x.ads.example", 80, false},
+		{"ads.example", 80, true},
+		{"127.0.0.1", 80, true}, // left to checkIP
+	}
+	for _, c := range hosts {
+		err := p.checkHost(c.host, c.port)
+		if (err == nil) != c.ok {
+			t.Errorf("%s:%d: expect allowed %v, got %v", c.host, c.port, c.ok, err)
+		}
+		if err != nil && !errors.Is(err, ErrConnectionNotAllowed) {
+			t.Errorf("%s:%d: expect ErrConnectionNotAllowed, got %v", c.host, c.port, err)
+		}
+	}
+
+	ips := []struct {
+		ip string
+		ok bool
+	}{
+		{"93.184.216.34", true},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"192.168.1.1", false},
+		{"10.2.0.1", false},
+		{"10.1.2.3", true},
+		{"203.0.113.7", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::10.0.0.1", false},
+		{"64:ff9b::203.0.113.7", false},
+		{"64:ff9b::93.184.216.34", true},
+		{"64:ff9b:1::1", false},
+		{"::ffff:0:192.168.0.1", false},
+		{"::127.0.0.1", false},
+		{"2002:7f00:1::1", false},              // 6to4 of 127.0.0.1
+		{"2002:c0a8:101::1", false},            // 6to4 of 192.168.1.1
+		{"2002:5db8:d822::1", true},            // 6to4 of 93.184.216.34
+		{"2001:0:4136:e378::f5ff:fffe", false}, // Teredo client 10.0.0.1
+		{"2001:0:4136:e378::a247:27dd", true},  // Teredo client 93.184.216.34
+		{"2606:4700::1111", true},
+	}
+	for _, c := range ips {
+		if err := p.checkIP(net.ParseIP(c.ip)); (err == nil) != c.ok {
+			t.Errorf("%s: expect allowed %v, got %v", c.ip, c.ok, err)
+		}
+	}
+}
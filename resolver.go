@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// dnsUpstream is a dns server reached over udp (tcp for truncated
+// answers), tcp or tls.
+type dnsUpstream struct {
+	network    string
+	addr       string
+	serverName string
+}
+
+// parseDNSUpstream reads 8.8.8.8, udp://8.8.8.8:53, tcp://1.1.1.1 or
+// tls://1.1.1.1#cloudflare-dns.com, the fragment naming the certificate
+// to expect.
+func parseDNSUpstream(s string) (*dnsUpstream, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		s = net.JoinHostPort(s, "53")
+	}
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	up := &dnsUpstream{network: u.Scheme}
+	switch u.Scheme {
+	case "udp", "tcp":
+		up.addr = hostPort(u.Host, "53")
+	case "tls":
+		up.addr = hostPort(u.Host, "853")
+		up.serverName = u.Fragment
+		if up.serverName == "" {
+			up.serverName = u.Hostname()
+		}
+	default:
+		return nil, fmt.Errorf("unsupported dns upstream %q, expect udp://, tcp:// or tls://", s)
+	}
+	return up, nil
+}
+
+func (up *dnsUpstream) String() string {
+	return up.network + "://" + up.addr
+}
+
+func (up *dnsUpstream) exchange(query []byte) ([]byte, error) {
+	if up.network == "udp" {
+		return exchangeDNS(up.addr, query)
+	}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: dnsTimeout}
+	if up.network == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", up.addr, &tls.Config{ServerName: up.serverName})
+	} else {
+		conn, err = dialer.Dial("tcp", up.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if err = writeDNS(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNS(conn)
+}
+
+// dnsResolver looks up destinations for the server dialer. Names pinned in
+// hosts come first, then the cache, then the upstreams of the longest
+// matching domain or else the default ones, tried in order. With no
+// upstreams the system resolver is asked.
+type dnsResolver struct {
+	upstreams []*dnsUpstream
+	domains   map[string][]*dnsUpstream
+	hosts     map[string][]net.IP
+	cache     *dnsCache
+}
+
+func newDNSResolver() *dnsResolver {
+	return &dnsResolver{
+		domains: make(map[string][]*dnsUpstream),
+		hosts:   make(map[string][]net.IP),
+		cache:   newDNSCache(),
+	}
+}
+
+func (r *dnsResolver) addUpstreams(list []string) error {
+	for _, s := range list {
+		up, err := parseDNSUpstream(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		r.upstreams = append(r.upstreams, up)
+	}
+	return nil
+}
+
+// addDomains reads domain=upstream pairs, sending the domain and its
+// subdomains to their own upstreams.
+func (r *dnsResolver) addDomains(pairs []string) error {
+	for _, pair := range pairs {
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			return fmt.Errorf("invalid resolver domain %q, expect domain=upstream", pair)
+		}
+		up, err := parseDNSUpstream(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return err
+		}
+		domain := strings.ToLower(strings.Trim(pair[:i], ". "))
+		r.domains[domain] = append(r.domains[domain], up)
+	}
+	return nil
+}
+
+// addHosts reads name=address pairs.
+func (r *dnsResolver) addHosts(pairs []string) error {
+	for _, pair := range pairs {
+		i := strings.IndexByte(pair, '=')
+		ip := net.ParseIP(strings.TrimSpace(pair[i+1:]))
+		if i <= 0 || ip == nil {
+			return fmt.Errorf("invalid host %q, expect name=address", pair)
+		}
+		name := strings.ToLower(strings.TrimSuffix(pair[:i], "."))
+		r.hosts[name] = append(r.hosts[name], ip)
+	}
+	return nil
+}
+
+// loadHosts reads a file in the format of /etc/hosts.
+func (r *dnsResolver) loadHosts(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("hosts line %d: expect address name", n)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			r.hosts[name] = append(r.hosts[name], ip)
+		}
+	}
+	return scanner.Err()
+}
+
+func (r *dnsResolver) upstreamsFor(name string) []*dnsUpstream {
+	for domain := name; ; {
+		if ups, ok := r.domains[domain]; ok {
+			return ups
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return r.upstreams
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// lookup returns the IPv4 and IPv6 addresses of name.
+func (r *dnsResolver) lookup(ctx context.Context, name string) ([]net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+	if r != nil {
+		if ips, ok := r.hosts[key]; ok {
+			return ips, nil
+		}
+	}
+	var upstreams []*dnsUpstream
+	if r != nil {
+		upstreams = r.upstreamsFor(key)
+	}
+	if len(upstreams) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		ips := make([]net.IP, len(addrs))
+		for i := range addrs {
+			ips[i] = addrs[i].IP
+		}
+		return ips, err
+	}
+
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func(qtype uint16) {
+			ips, err := r.query(key, qtype, upstreams)
+			results <- result{ips, err}
+		}(qtype)
+	}
+	var ips []net.IP
+	var err error
+	for i := 0; i < 2; i++ {
+		select {
+		case res := <-results:
+			ips = append(ips, res.ips...)
+			if res.err != nil {
+				err = res.err
+			}
+		case <-ctx.Done():
+			return nil, &net.DNSError{Err: ctx.Err().Error(), Name: name, IsTimeout: true}
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil, err
+}
+
+// query asks for one record type of name, from the cache or else from
+// the first upstream giving an answer.
+func (r *dnsResolver) query(name string, qtype uint16, upstreams []*dnsUpstream) ([]net.IP, error) {
+	query, err := newDNSQuery(name, qtype)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	q, err := parseDNS(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var m *dnsMessage
+	if answer := r.cache.get(q.key, query[:2]); answer != nil {
+		m, err = parseDNS(answer)
+	} else {
+		for _, up := range upstreams {
+			answer, err = up.exchange(query)
+			if err == nil {
+				m, err = parseDNS(answer)
+			}
+			if err == nil && m.key == q.key && m.rcode != dnsRcodeServFail {
+				r.cache.put(answer)
+				break
+			}
+			if err == nil {
+				err = errDNSFailed
+			}
+			log.Debugf("dns %s via %s: %v", name, up, err)
+		}
+	}
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+	}
+	switch m.rcode {
+	case 0:
+		return m.ips, nil
+	case dnsRcodeNXDomain:
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+}
+
+// forward answers a query of a client from the cache or else from the
+// first upstream giving an answer, the upstreams picked for its name as
+// for lookups. With no upstreams the system nameserver is asked.
+func (r *dnsResolver) forward(query []byte) ([]byte, error) {
+	if r == nil {
+		return exchangeDNS(systemNameserver(), query)
+	}
+	q, err := parseDNS(query)
+	if err != nil {
+		return nil, err
+	}
+	if answer := r.cache.get(q.key, query[:2]); answer != nil {
+		return answer, nil
+	}
+	// the key is the name with its root dot, QTYPE and QCLASS
+	upstreams := r.upstreamsFor(strings.TrimSuffix(q.key[:len(q.key)-4], "."))
+	if len(upstreams) == 0 {
+		return exchangeDNS(systemNameserver(), query)
+	}
+	for _, up := range upstreams {
+		var answer []byte
+		var m *dnsMessage
+		answer, err = up.exchange(query)
+		if err == nil {
+			m, err = parseDNS(answer)
+		}
+		if err == nil && m.key == q.key && m.rcode != dnsRcodeServFail {
+			r.cache.put(answer)
+			return answer, nil
+		}
+		if err == nil {
+			err = errDNSFailed
+		}
+		log.Debugf("dns query via %s: %v", up, err)
+	}
+	return nil, err
+}
+
+// newDNSQuery builds a recursive query for name.
+func newDNSQuery(name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 12+len(name)+6)
+	copy(msg, genRandBytes(2))
+	msg[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name")
+		}
+		msg = append(append(msg, byte(len(label))), label...)
+	}
+	if len(msg) > 12+254 {
+		return nil, fmt.Errorf("invalid name")
+	}
+	// root, QTYPE, QCLASS IN
+	return append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// answeringDNS serves udp queries with the records answer returns,
+// counting the queries it got.
+func answeringDNS(t *testing.T, answer func(name string, qtype uint16) (rcode byte, ips []net.IP)) (string, *int32) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	count := new(int32)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(count, 1)
+			name, off, err := dnsName(buf[:n], 12)
+			if err != nil {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(buf[off:])
+			rcode, ips := answer(name, qtype)
+			msg := append([]byte(nil), buf[:off+4]...)
+			msg[2], msg[3] = 0x81, 0x80|rcode
+			binary.BigEndian.PutUint16(msg[6:], uint16(len(ips)))
+			for _, ip := range ips {
+				rr := []byte{0xc0, 12, 0, byte(qtype), 0, 1, 0, 0, 1, 44, 0, byte(len(ip))}
+				msg = append(append(msg, rr...), ip...)
+			}
+			_, _ = conn.WriteToUDP(msg, src)
+		}
+	}()
+	return conn.LocalAddr().String(), count
+}
+
+func TestDNSResolver(t *testing.T) {
+	main, mainCount := answeringDNS(t, func(name string, qtype uint16) (byte, []net.IP) {
+		switch {
+		case name == "missing.example.":
+			return dnsRcodeNXDomain, nil
+		case qtype == dnsTypeA:
+			return 0, []net.IP{net.IPv4(192, 0, 2, 1).To4()}
+		}
+		return 0, []net.IP{net.ParseIP("2001:db8::1")}
+	})
+	corp, _ := answeringDNS(t, func(name string, qtype uint16) (byte, []net.IP) {
+		if qtype == dnsTypeA {
+			return 0, []net.IP{net.IPv4(10, 0, 0, 1).To4()}
+		}
+		return 0, nil
+	})
+
+	r := newDNSResolver()
+	// a dead upstream first, the next one takes over
+	for _, err := range []error{
+		r.addUpstreams([]string{"udp://127.0.0.1:1", "udp://" + main}),
+		r.addDomains([]string{"corp.example=" + corp}),
+		r.addHosts([]string{"pinned.example=203.0.113.9"}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lookup := func(name string) ([]net.IP, error) {
+		return r.lookup(context.Background(), name)
+	}
+	ips, err := lookup("www.example.com")
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("expect an A and an AAAA record, got %v %v", ips, err)
+	}
+	queries := atomic.LoadInt32(mainCount)
+	if _, err = lookup("WWW.example.com."); err != nil || atomic.LoadInt32(mainCount) != queries {
+		t.Errorf("expect a cached answer, %v", err)
+	}
+
+	var dnsErr *net.DNSError
+	for i := 0; i < 2; i++ {
+		_, err = lookup("missing.example")
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("expect not found, got %v", err)
+		}
+	}
+	if atomic.LoadInt32(mainCount) != queries+2 {
+		t.Errorf("expect the negative answer cached, got %d queries", atomic.LoadInt32(mainCount)-queries)
+	}
+
+	if ips, err = lookup("git.corp.example"); err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("expect the corp upstream answer, got %v %v", ips, err)
+	}
+	if ips, err = lookup("pinned.example"); err != nil || !ips[0].Equal(net.IPv4(203, 0, 113, 9)) {
+		t.Errorf("expect the pinned address, got %v %v", ips, err)
+	}
+
+	// client queries take the same upstreams
+	query, _ := newDNSQuery("git.corp.example", dnsTypeA)
+	answer, err := r.forward(query)
+	if err == nil {
+		var m *dnsMessage
+		if m, err = parseDNS(answer); err == nil {
+			ips = m.ips
+		}
+	}
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) || answer[0] != query[0] || answer[1] != query[1] {
+		t.Errorf("expect the corp upstream answer forwarded, got %v %v", ips, err)
+	}
+
+	for _, bad := range []string{"quic://1.1.1.1", "tls://[::1"} {
+		if _, err := parseDNSUpstream(bad); err == nil {
+			t.Errorf("%q: expect error", bad)
+		}
+	}
+	up, _ := parseDNSUpstream("tls://1.1.1.1#cloudflare-dns.com")
+	if up.addr != "1.1.1.1:853" || up.serverName != "cloudflare-dns.com" {
+		t.Errorf("unexpected upstream %+v", up)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reverse is a remote port forward: the server listens on Bind and every
+// accepted connection is dialed to Target from the client side.
+type Reverse struct {
+	Bind   string
+	Target string
+}
+
+// portRange is an inclusive range of ports a client may bind on the server.
+type portRange struct {
+	lo, hi int
+}
+
+// parseReverse parses server_addr=local_host:port.
+func parseReverse(s string) (*Reverse, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid remote forward %q, expect server_addr=local_host:port", s)
+	}
+	r := &Reverse{Bind: s[:i], Target: s[i+1:]}
+	if ParseAddr(r.Bind) == nil || ParseAddr(r.Target) == nil {
+		return nil, fmt.Errorf("invalid remote forward %q, expect server_addr=local_host:port", s)
+	}
+	return r, nil
+}
+
+// parsePortRanges parses a list of ports and lo-hi ranges.
+func parsePortRanges(list []string) (ranges []portRange, err error) {
+	for _, s := range list {
+		for _, f := range strings.Split(s, ",") {
+			lo, hi := f, f
+			if i := strings.IndexByte(f, '-'); i >= 0 {
+				lo, hi = f[:i], f[i+1:]
+			}
+			var r portRange
+			if r.lo, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+				return nil, fmt.Errorf("invalid port range %q", f)
+			}
+			if r.hi, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+				return nil, fmt.Errorf("invalid port range %q", f)
+			}
+			if r.lo < 1 || r.hi > 65535 || r.lo > r.hi {
+				return nil, fmt.Errorf("invalid port range %q", f)
+			}
+			ranges = append(ranges, r)
+		}
+	}
+	return
+}
+
+func (c *muxConn) listen(host string) (n int, err error) {
+	n, err = c.send(c.id, flagListen, []byte(host))
+	return
+}
+
+// listenRemote keeps a reverse listener registered on the server, again
+// after the websocket carrying it went away.
+func (client *Client) listenRemote(r *Reverse) {
+	for {
+		c, rep, bnd, err := client.register(r)
+		if err != nil || rep != 0 {
+			if rep == byte(ErrConnectionNotAllowed) {
+				log.Errorf("remote forward %s refused by server policy", r.Bind)
+				return
+			}
+			log.Warnf("remote forward %s failed: %v", r.Bind, replyCode(err))
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		log.Infof("Remote forwarding %s to %s", bnd.String(), r.Target)
+		<-c.done
+		log.Warnf("remote forward %s closed, registering again", r.Bind)
+		time.Sleep(time.Second)
+	}
+}
+
+// register asks the server to listen for r, the stream returned carries
+// the listener. On a failure the stream is closed already.
+func (client *Client) register(r *Reverse) (c *muxConn, rep byte, bnd Addr, err error) {
+	c = createConn(nil)
+	c.target = r.Target
+	if _, err = c.listen(r.Bind); err != nil {
+		_ = c.Close()
+		return
+	}
+	rep, bnd, err = c.waitReply(replyTimeout)
+	if err != nil || rep != 0 {
+		_ = c.Close()
+	}
+	return
+}
+
+// acceptHandler serves a stream opened by the server for a reverse listener.
+func (client *Client) acceptHandler(target string, c *muxConn) {
+	log.Debugf("connection %x, accept to %s", c.id, target)
+	conn, err := net.DialTimeout("tcp", target, replyTimeout)
+	if err != nil {
+		log.Warn("dial error: ", err)
+		_ = c.Close()
+		return
+	}
+	if !c.attach(conn) {
+		_ = conn.Close()
+		return
+	}
+
+	err = transfer.Invoke(&dataPack{
+		netConn: conn,
+		muxConn: c,
+	})
+	if err != nil {
+		log.Warnf("invoke error: %v", err)
+		_ = c.Close()
+		return
+	}
+}
+
+func (server *Server) bindAllowed(port int) bool {
+	for _, r := range server.BindPorts {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *Server) listenHandler(host string, c *muxConn) {
+	log.Debugf("connection %x, listen on %s", c.id, host)
+
+	addr, err := net.ResolveTCPAddr("tcp", host)
+	if err != nil {
+		_, _ = c.reply(byte(replyCode(err)), nil)
+		_ = c.Close()
+		return
+	}
+	if !server.bindAllowed(addr.Port) {
+		log.Warnf("connection %x, listen on %s denied by policy", c.id, host)
+		_, _ = c.reply(byte(ErrConnectionNotAllowed), nil)
+		_ = c.Close()
+		return
+	}
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		log.Warn("listen error: ", err)
+		_, _ = c.reply(byte(ErrGeneralFailure), nil)
+		_ = c.Close()
+		return
+	}
+	c.ln = ln
+
+	_, err = c.reply(0, ParseAddr(ln.Addr().String()))
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			break
+		}
+		s := &muxConn{
+			conn: conn,
+			ws:   c.ws,
+		}
+		s.pipeR, s.pipeW = newPipe()
+		if !c.ws.openStream(s) {
+			// the client moves its listener to a new websocket
+			log.Warnf("connection %x, out of stream ids", c.id)
+			_ = conn.Close()
+			_ = c.ws.conn.Close()
+			break
+		}
+
+		// ACCEPT carries the listener stream id and the peer address
+		_, err = s.send(s.id, flagAccept, append(append([]byte(nil), c.id...),
+			ParseAddr(conn.RemoteAddr().String())...))
+		if err != nil {
+			_ = s.Close()
+			break
+		}
+		err = transfer.Invoke(&dataPack{
+			netConn: conn,
+			muxConn: s,
+		})
+		if err != nil {
+			log.Warnf("invoke error: %v", err)
+			_ = s.Close()
+		}
+	}
+	log.Debugf("connection %x, listener on %s closed", c.id, host)
+	_ = c.Close()
+}
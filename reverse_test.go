@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestParseReverse(t *testing.T) {
+	r, err := parseReverse("0.0.0.0:8000=127.0.0.1:22")
+	if err != nil || r.Bind != "0.0.0.0:8000" || r.Target != "127.0.0.1:22" {
+		t.Errorf("got %+v %v", r, err)
+	}
+	if _, err = parseReverse("0.0.0.0:8000"); err == nil {
+		t.Error("accepted a remote forward without target")
+	}
+	ranges, err := parsePortRanges([]string{"8000-8100,9000", "22"})
+	if err != nil || len(ranges) != 3 || ranges[0] != (portRange{8000, 8100}) || ranges[1] != (portRange{9000, 9000}) {
+		t.Errorf("got %v %v", ranges, err)
+	}
+	for _, s := range []string{"0", "8100-8000", "70000", "x-1"} {
+		if _, err = parsePortRanges([]string{s}); err == nil {
+			t.Errorf("%s: accepted", s)
+		}
+	}
+}
+
+// TestReverse registers a -R listener on the server, a connection to it
+// reaches the target on the client side, and a port outside the allowed
+// ranges is refused.
+func TestReverse(t *testing.T) {
+	startServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+	defer func(ports []portRange) { server.BindPorts = ports }(server.BindPorts)
+	server.BindPorts = []portRange{{port, port}}
+
+	client := new(Client)
+	bind := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	c, rep, bnd, err := client.register(&Reverse{Bind: bind, Target: startEchoTCP(t)})
+	if err != nil || rep != 0 {
+		t.Fatalf("listen refused with %d: %v", rep, err)
+	}
+	defer c.Close()
+	if bnd.String() != bind {
+		t.Errorf("listening on %s, want %s", bnd, bind)
+	}
+
+	conn, err := net.Dial("tcp", bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ping(t, conn)
+
+	_, rep, _, err = client.register(&Reverse{Bind: "127.0.0.1:1", Target: bind})
+	if err != nil || Error(rep) != ErrConnectionNotAllowed {
+		t.Errorf("listen outside the allowed ports replied %d %v", rep, err)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action decides how a connection accepted by the client is served.
+type Action byte
+
+const (
+	ActionProxy Action = iota
+	ActionDirect
+	ActionReject
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionDirect:
+		return "direct"
+	case ActionReject:
+		return "reject"
+	}
+	return "proxy"
+}
+
+func parseAction(s string) (Action, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "proxy":
+		return ActionProxy, nil
+	case "direct":
+		return ActionDirect, nil
+	case "reject":
+		return ActionReject, nil
+	}
+	return 0, fmt.Errorf("unknown action %q", s)
+}
+
+type rule struct {
+	kind    string
+	value   string
+	re      *regexp.Regexp
+	ipNet   *net.IPNet
+	lo, hi  int
+	action  Action
+	resolve bool
+}
+
+// Router matches destinations against an ordered list of rules, the first
+// match wins. Rules are read one per line from a file:
+//
+//	DOMAIN,host.example.com,proxy
+//	DOMAIN-SUFFIX,example.com,direct
+//	DOMAIN-KEYWORD,tracker,reject
+//	DOMAIN-REGEX,^ads?\.,reject
+//	IP-CIDR,10.0.0.0/8,direct
+//	DST-PORT,22,direct (or a range, 6881-6889)
+//	GEOIP,CN,direct
+//	IP-ASN,13335,proxy
+//	FINAL,proxy
+//
+// IP rules resolve domain destinations unless they end in ",no-resolve",
+// through lookup when set, else locally. GEOIP and IP-ASN need a database
+// loaded with --geoip.
+type Router struct {
+	sync.RWMutex
+	rules   []*rule
+	final   Action
+	geo     *geoDB
+	file    string
+	modTime time.Time
+	lookup  func(host string) []net.IP
+}
+
+func loadRouter(file string, geo *geoDB) (*Router, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	router, err := parseRules(f, geo)
+	if err != nil {
+		return nil, err
+	}
+	router.file, router.modTime = file, info.ModTime()
+	return router, nil
+}
+
+// watch reloads the rules whenever their file changes. A broken file is
+// reported and the rules in use are kept.
+func (router *Router) watch() {
+	for {
+		time.Sleep(5 * time.Second)
+		info, err := os.Stat(router.file)
+		if err != nil || info.ModTime().Equal(router.modTime) {
+			continue
+		}
+		next, err := loadRouter(router.file, router.geo)
+		if err != nil {
+			log.Warnf("reloading rules failed: %v", err)
+			router.modTime = info.ModTime()
+			continue
+		}
+		router.Lock()
+		router.rules, router.final, router.modTime = next.rules, next.final, next.modTime
+		router.Unlock()
+		log.Infof("rules reloaded from %s", router.file)
+	}
+}
+
+func parseRules(r io.Reader, geo *geoDB) (router *Router, err error) {
+	router = &Router{geo: geo}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		kind := strings.ToUpper(fields[0])
+
+		if kind == "FINAL" || kind == "MATCH" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("rules line %d: expect %s,action", n, kind)
+			}
+			if router.final, err = parseAction(fields[1]); err != nil {
+				return nil, fmt.Errorf("rules line %d: %v", n, err)
+			}
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("rules line %d: expect type,value,action", n)
+		}
+		if len(fields) == 4 && fields[3] != "no-resolve" {
+			return nil, fmt.Errorf("rules line %d: unknown option %q", n, fields[3])
+		}
+
+		ru := &rule{kind: kind, value: strings.ToLower(fields[1]), resolve: len(fields) == 3}
+		if ru.action, err = parseAction(fields[2]); err != nil {
+			return nil, fmt.Errorf("rules line %d: %v", n, err)
+		}
+		switch kind {
+		case "DOMAIN", "DOMAIN-KEYWORD":
+		case "DOMAIN-SUFFIX":
+			ru.value = strings.TrimPrefix(ru.value, ".")
+		case "DOMAIN-REGEX":
+			ru.re, err = regexp.Compile(fields[1])
+		case "IP-CIDR", "IP-CIDR6":
+			_, ru.ipNet, err = net.ParseCIDR(fields[1])
+		case "DST-PORT":
+			var ranges []portRange
+			ranges, err = parsePortRanges([]string{fields[1]})
+			if err == nil {
+				ru.lo, ru.hi = ranges[0].lo, ranges[0].hi
+			}
+		case "GEOIP", "IP-ASN":
+			if geo == nil {
+				err = fmt.Errorf("%s needs a geoip database", kind)
+			}
+			if kind == "IP-ASN" {
+				ru.value = strings.TrimPrefix(ru.value, "as")
+			}
+			ru.value = strings.ToUpper(ru.value)
+		default:
+			err = fmt.Errorf("unknown rule type %q", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rules line %d: %v", n, err)
+		}
+		router.rules = append(router.rules, ru)
+	}
+	return router, scanner.Err()
+}
+
+// Route returns the action of the first rule matching addr. Reloads swap
+// the rules whole, so they are matched, and the destination resolved, out
+// of the lock.
+func (router *Router) Route(addr Addr) Action {
+	router.RLock()
+	rules, final := router.rules, router.final
+	router.RUnlock()
+
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return final
+	}
+	port, _ := strconv.Atoi(portStr)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+		host = ""
+	}
+	resolved := ips != nil
+
+	for _, ru := range rules {
+		var ok bool
+		switch ru.kind {
+		case "DOMAIN":
+			ok = host == ru.value
+		case "DOMAIN-SUFFIX":
+			ok = host == ru.value || strings.HasSuffix(host, "."+ru.value)
+		case "DOMAIN-KEYWORD":
+			ok = host != "" && strings.Contains(host, ru.value)
+		case "DOMAIN-REGEX":
+			ok = host != "" && ru.re.MatchString(host)
+		case "DST-PORT":
+			ok = port >= ru.lo && port <= ru.hi
+		default:
+			if !resolved && ru.resolve {
+				if router.lookup != nil {
+					ips = router.lookup(host)
+				} else {
+					ips = lookupIP(host)
+				}
+				resolved = true
+			}
+			for _, ip := range ips {
+				if ok = router.matchIP(ru, ip); ok {
+					break
+				}
+			}
+		}
+		if ok {
+			log.Debugf("route %s -> %s (%s,%s)", addr.String(), ru.action, ru.kind, ru.value)
+			return ru.action
+		}
+	}
+	return final
+}
+
+func (router *Router) matchIP(ru *rule, ip net.IP) bool {
+	switch ru.kind {
+	case "IP-CIDR", "IP-CIDR6":
+		return ru.ipNet.Contains(ip)
+	case "GEOIP":
+		e := router.geo.lookup(ip)
+		return e != nil && e.country == ru.value
+	case "IP-ASN":
+		e := router.geo.lookup(ip)
+		return e != nil && e.asn == ru.value
+	}
+	return false
+}
+
+func lookupIP(host string) []net.IP {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		log.Debugf("route lookup %s: %v", host, err)
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+	return ips
+}
+
+type geoEntry struct {
+	start, end net.IP
+	asn        string
+	country    string
+}
+
+// geoDB maps address ranges to their country and ASN, read from the
+// ip2asn tsv format: range_start range_end AS_number country_code AS_name.
+type geoDB struct {
+	entries []*geoEntry
+}
+
+func loadGeoDB(file string) (*geoDB, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db := new(geoDB)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("geoip line %d: expect range_start range_end asn country", n)
+		}
+		e := &geoEntry{
+			start:   net.ParseIP(fields[0]).To16(),
+			end:     net.ParseIP(fields[1]).To16(),
+			asn:     fields[2],
+			country: strings.ToUpper(fields[3]),
+		}
+		if e.start == nil || e.end == nil {
+			return nil, fmt.Errorf("geoip line %d: invalid range", n)
+		}
+		db.entries = append(db.entries, e)
+	}
+	sort.Slice(db.entries, func(i, j int) bool {
+		return bytes.Compare(db.entries[i].start, db.entries[j].start) < 0
+	})
+	return db, scanner.Err()
+}
+
+func (db *geoDB) lookup(ip net.IP) *geoEntry {
+	ip = ip.To16()
+	i := sort.Search(len(db.entries), func(i int) bool {
+		return bytes.Compare(db.entries[i].start, ip) > 0
+	})
+	if i == 0 {
+		return nil
+	}
+	if e := db.entries[i-1]; bytes.Compare(ip, e.end) <= 0 {
+		return e
+	}
+	return nil
+}
+
+// direct serves conn without the tunnel.
+func (client *Client) direct(conn *bufConn, addr Addr, reply func(rep byte, bnd Addr) error) {
+	out, err := net.DialTimeout("tcp", addr.String(), replyTimeout)
+	if err != nil {
+		log.Debugf("direct dial %s: %v", addr, err)
+		_ = reply(byte(replyCode(err)), nil)
+		_ = conn.SetLinger(-1)
+		_ = conn.Close()
+		return
+	}
+	err = reply(0, ParseAddr(out.LocalAddr().String()))
+	if err != nil {
+		_ = out.Close()
+		_ = conn.Close()
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(out, conn)
+		_ = out.(*net.TCPConn).CloseWrite()
+	}()
+	_, _ = io.Copy(conn, out)
+	_ = conn.Close()
+	_ = out.Close()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testRules = `
+# shared team rules
+DOMAIN,exact.example.org,reject
+DOMAIN-SUFFIX,corp.example,direct
+DOMAIN-KEYWORD,tracker,reject
+DOMAIN-REGEX,^ads?\.,reject
+IP-CIDR,10.0.0.0/8,direct,no-resolve
+IP-CIDR6,fd00::/8,direct,no-resolve
+DST-PORT,6881-6889,direct
+GEOIP,cn,direct,no-resolve
+IP-ASN,AS13335,reject,no-resolve
+FINAL,proxy
+`
+
+const testGeoDB = "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+	"1.0.1.0\t1.0.3.255\t0\tCN\tNone\n" +
+	"2001:250::\t2001:250:ffff:ffff:ffff:ffff:ffff:ffff\t23910\tCN\tCERNET\n"
+
+func TestRouter(t *testing.T) {
+	f, err := ioutil.TempFile("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(testGeoDB)
+	_ = f.Close()
+
+	geo, err := loadGeoDB(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := parseRules(strings.NewReader(testRules), geo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		addr   string
+		action Action
+	}{
+		{"exact.example.org:443", ActionReject},
+		{"sub.exact.example.org:443", ActionProxy},
+		{"corp.example:80", ActionDirect},
+		{"git.CORP.example.:22", ActionDirect},
+		{"notcorp.example:80", ActionProxy},
+		{"my-tracker.net:443", ActionReject},
+		{"ad.example.com:80", ActionReject},
+		{"bad.example.com:80", ActionProxy},
+		{"10.1.2.3:5432", ActionDirect},
+		{"[fd12::1]:80", ActionDirect},
+		{"192.0.2.1:6885", ActionDirect},
+		{"1.0.2.1:80", ActionDirect},
+		{"[2001:250::1]:80", ActionDirect},
+		{"1.0.0.1:53", ActionReject},
+		{"8.8.8.8:53", ActionProxy},
+	}
+	for _, c := range cases {
+		if got := router.Route(ParseAddr(c.addr)); got != c.action {
+			t.Errorf("%s: expect %s, got %s", c.addr, c.action, got)
+		}
+	}
+}
+
+// TestRouterLookup resolves names for IP rules with the lookup given,
+// and not at all for ",no-resolve" ones.
+func TestRouterLookup(t *testing.T) {
+	router, err := parseRules(strings.NewReader("IP-CIDR,10.0.0.0/8,direct,no-resolve\nIP-CIDR,192.0.2.0/24,reject\nFINAL,proxy\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var asked []string
+	router.lookup = func(host string) []net.IP {
+		asked = append(asked, host)
+		return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("192.0.2.1")}
+	}
+	if got := router.Route(ParseAddr("intranet.example:80")); got != ActionReject {
+		t.Errorf("got %s, want reject", got)
+	}
+	if got := router.Route(ParseAddr("192.0.2.9:80")); got != ActionReject || len(asked) != 1 || asked[0] != "intranet.example" {
+		t.Errorf("got %s, looked up %q", got, asked)
+	}
+}
+
+func TestParseRulesError(t *testing.T) {
+	for _, rules := range []string{
+		"DOMAIN,example.com",
+		"DOMAIN,example.com,tunnel",
+		"IP-CIDR,10.0.0.0/33,direct",
+		"DST-PORT,0,direct",
+		"GEOIP,CN,direct",
+		"PROCESS,curl,direct",
+		"IP-CIDR,10.0.0.0/8,direct,resolve-later",
+	} {
+		if _, err := parseRules(strings.NewReader(rules), nil); err == nil {
+			t.Errorf("%q: expect error", rules)
+		}
+	}
+}
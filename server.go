@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -17,42 +21,165 @@ var (
 )
 
 type Server struct {
-	ListenAddr *url.URL
-	Reverse    *url.URL
-	Cert       string
-	PrivateKey string
-	Resolver   *websocket.Upgrader
-	CreatedAt  time.Time
+	ListenAddr     *url.URL
+	Reverse        *url.URL
+	Cert           string
+	PrivateKey     string
+	Resolver       *websocket.Upgrader
+	UDPTimeout     time.Duration
+	BindPorts      []portRange
+	Policy         *Policy
+	Chain          *chainDialer
+	Egress         *Router
+	Sources        *sourcePool
+	SourceMap      map[string]*sourcePool
+	DNS            *dnsResolver
+	Family         string
+	DialTimeout    time.Duration
+	AttemptTimeout time.Duration
+	CreatedAt      time.Time
 }
 
 func (server *Server) dialHandler(host string, c *muxConn) {
 	log.Debugf("connection %x, dial %s", c.id, host)
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", host)
+	name, port, _ := net.SplitHostPort(host)
+	portNum, _ := strconv.Atoi(port)
+	err := server.Policy.checkHost(name, portNum)
 	if err != nil {
-		log.Warnf(err.Error())
+		server.deny(host, c, err)
+		return
+	}
+	action := ActionProxy
+	if addr := ParseAddr(host); addr != nil && server.Egress != nil {
+		action = server.Egress.Route(addr)
+	}
+	if action == ActionReject {
+		server.deny(host, c, fmt.Errorf("rejected by egress rules: %w", ErrConnectionNotAllowed))
+		return
+	}
+	ctx, cancel := withTimeout(context.Background(), server.DialTimeout)
+	defer cancel()
+	chained := action == ActionProxy && server.Chain != nil
+
+	var conn net.Conn
+	var peer string
+	if chained && server.Chain.remoteDNS() && !server.Policy.checksNets() && net.ParseIP(name) == nil {
+		// the proxy resolves the name, no network rule could check what it
+		// reaches
+		peer = host
+		conn, err = server.Chain.DialContext(ctx, host, func(ip net.IP) net.Addr {
+			return server.source(c.ws, ip)
+		})
+	} else {
+		var addrs []net.IP
+		addrs, err = server.DNS.lookup(ctx, name)
+		if err != nil {
+			log.Warn(err)
+			_, _ = c.reply(byte(replyCode(err)), nil)
+			_ = c.Close()
+			return
+		}
+		// dial the checked addresses, never the name again
+		var ips []net.IP
+		for _, ip := range addrs {
+			if err = server.Policy.checkIP(ip); err == nil {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			server.deny(host, c, err)
+			return
+		}
+		ips = sortAddrs(ips, server.Family)
+		if len(ips) == 0 {
+			server.deny(host, c, fmt.Errorf("no %s address: %w", server.Family, ErrHostUnreachable))
+			return
+		}
+		conn, peer, err = server.dial(ctx, ips, port, chained, c.ws)
+	}
+	if err != nil {
+		log.Warnf("connection %x, dial %s: %v", c.id, host, err)
+		_, _ = c.reply(byte(replyCode(err)), nil)
 		_ = c.Close()
 		return
 	}
-	conn, err := net.Dial("tcp", tcpAddr.String())
+	if !c.attach(conn) {
+		_ = conn.Close()
+		return
+	}
+	log.Debugf("connection %x, dial %s reached %s", c.id, host, peer)
+
+	// the address reached follows the bound one
+	_, err = c.reply(0, append(ParseAddr(conn.LocalAddr().String()), ParseAddr(peer)...))
 	if err != nil {
-		log.Warn("dial error:", err)
 		_ = c.Close()
 		return
 	}
-	c.conn = conn
 
 	err = transfer.Invoke(&dataPack{
 		netConn: conn,
 		muxConn: c,
 	})
 	if err != nil {
-		log.Warn("invoke error: %V", err)
+		log.Warnf("invoke error: %v", err)
 		_ = c.Close()
 		return
 	}
 }
 
+// dial races connections to ips, through the upstream proxy when chained,
+// where each attempt is a connection to the proxy of its own. It returns
+// the destination reached along with the connection.
+func (server *Server) dial(ctx context.Context, ips []net.IP, port string, chained bool,
+	ws *webSocket) (net.Conn, string, error) {
+	var reached sync.Map
+	conn, err := dialRace(ctx, ips, server.AttemptTimeout, func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		addr := net.JoinHostPort(ip.String(), port)
+		var conn net.Conn
+		var err error
+		if chained {
+			conn, err = server.Chain.DialContext(ctx, addr, func(ip net.IP) net.Addr {
+				return server.source(ws, ip)
+			})
+		} else {
+			dialer := &net.Dialer{LocalAddr: server.source(ws, ip)}
+			conn, err = dialer.DialContext(ctx, "tcp", addr)
+		}
+		if err == nil {
+			reached.Store(conn, addr)
+		}
+		return conn, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	peer, _ := reached.Load(conn)
+	return conn, peer.(string), nil
+}
+
+// source picks the local address reaching ip for the websocket's
+// identity, falling back to the shared pool.
+func (server *Server) source(ws *webSocket, ip net.IP) net.Addr {
+	pool := server.Sources
+	if p, ok := server.SourceMap[ws.identity]; ok {
+		pool = p
+	}
+	if addr := pool.pick(ip); addr != nil {
+		log.Debugf("dial %v from %v", ip, addr.IP)
+		return addr
+	}
+	return nil
+}
+
+// deny refuses a destination the policy does not allow, telling the client
+// why by the reply code.
+func (server *Server) deny(host string, c *muxConn, err error) {
+	log.Warnf("connection %x, dial %s denied: %v", c.id, host, err)
+	_, _ = c.reply(byte(replyCode(err)), nil)
+	_ = c.Close()
+}
+
 func (server *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	hFunc, err := hashSelector(r.Header.Get("via"))
@@ -62,12 +189,28 @@ func (server *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !validateStringCode("authenticate", r.Header.Get("Auth"), hFunc) {
+	// the identity is only a name the client claims, any holder of the key
+	// may give any; the auth code just keeps it from being altered on the way
+	id := r.Header.Get("Identity")
+	if !validateStringCode("authenticate"+id, r.Header.Get("Auth"), hFunc) {
 		log.Warnf("auth invalid from %s", r.RemoteAddr)
 		http.NotFound(w, r)
 		return
 	}
-	c, err := server.Resolver.Upgrade(w, r, nil)
+	token := r.Header.Get("Session")
+	if token != "" && r.Header.Get("Session-Received") != "" {
+		var ws *webSocket
+		if v, ok := sessions.Load(token); ok {
+			ws = v.(*webSocket)
+		}
+		server.resumeWebSocket(w, r, ws)
+		return
+	}
+	var header http.Header
+	if token != "" && resumeTimeout > 0 && offersV2(r) {
+		header = http.Header{"Session": {token}}
+	}
+	c, err := server.Resolver.Upgrade(w, r, header)
 	if err != nil {
 		log.Println(err)
 		return
@@ -76,14 +219,64 @@ func (server *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	ws := &webSocket{
 		id:       genRandBytes(wsAddrLen),
 		hashFunc: hFunc,
+		identity: id,
+		version:  wireVersionOf(c),
+		flow:     newFlow(),
+		streams:  make(map[uint32]*muxConn),
+		nextID:   firstStreamID(false),
 		conn:     &wsConn{c},
-		closed:   false,
 		buf:      bytes.NewBuffer(make([]byte, wsReadBuf)),
 	}
+	if header != nil && ws.version >= protocolV2 {
+		ws.session = newSession(token)
+		sessions.Store(token, ws)
+	}
 	wsPool.Store(u64(ws.id), ws)
+	ws.startKeepalive()
+	go wsHandler(ws)
+}
+
+// resumeWebSocket hands the session of ws to the connection of a client
+// resuming it. If the session is gone or can not be resumed the client gets
+// a websocket without the Session-Resumed header, closed at once.
+func (server *Server) resumeWebSocket(w http.ResponseWriter, r *http.Request, ws *webSocket) {
+	received, err := strconv.ParseUint(r.Header.Get("Session-Received"), 10, 64)
+	if ws == nil || err != nil || ws.identity != r.Header.Get("Identity") || !ws.takeOver() {
+		log.Warnf("session from %s not resumable", r.RemoteAddr)
+		if c, err := server.Resolver.Upgrade(w, r, nil); err == nil {
+			_ = c.Close()
+		}
+		return
+	}
+	c, err := server.Resolver.Upgrade(w, r, http.Header{
+		"Session-Resumed": {strconv.FormatUint(ws.session.received, 10)},
+	})
+	if err != nil {
+		log.Println(err)
+		ws.resumed(false)
+		return
+	}
+	if !ws.attach(c, received) {
+		log.Warnf("websocket connection %v missed more than was kept", u64(ws.id))
+		_ = c.Close()
+		ws.close()
+		return
+	}
+	ws.resumed(true)
+	log.Infof("websocket connection %v resumed from %s", u64(ws.id), r.RemoteAddr)
+	ws.startKeepalive()
 	go wsHandler(ws)
 }
 
+func offersV2(r *http.Request) bool {
+	for _, p := range websocket.Subprotocols(r) {
+		if p == subprotocolV2 {
+			return true
+		}
+	}
+	return false
+}
+
 func (server *Server) Listen() (err error) {
 
 	mux := http.NewServeMux()
@@ -98,6 +291,10 @@ func (server *Server) Listen() (err error) {
 		})
 	}
 
+	if server.Egress != nil {
+		go server.Egress.watch()
+	}
+
 	s := http.Server{
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sessions let the streams of a v2 websocket outlive its connection. Every
+// message but acks is numbered by order of sending and kept until the peer
+// acknowledges it; an ack is a message of a single ack frame counting the
+// messages received. When the connection drops, the client dials again
+// with the session token and the count of messages it received, the server
+// answers with its own count and both resend what the other missed, so the
+// streams carry on unaware. The server keeps a session that lost its
+// connection for resumeTimeout. Past sessionKeep bytes the oldest messages
+// are dropped unacknowledged, a peer that missed one of them can not
+// resume.
+const (
+	ackEvery    = 64
+	ackBytes    = 256 * 1024
+	sessionKeep = 16 << 20
+)
+
+var (
+	flagAck = []byte("d")
+
+	resumeTimeout = 30 * time.Second
+	sessions      sync.Map // token → *webSocket, server only
+)
+
+type session struct {
+	token string
+
+	// guarded by ws.lock
+	sent, acked uint64
+	first       uint64   // number of the oldest message kept, acked or later
+	buf         [][]byte // messages first to sent
+	bufBytes    int
+	keepBytes   int
+	resending   bool   // messages are only kept, the resend sends them
+	ackDue      uint64 // count to acknowledge once the resend is done
+
+	// reader only
+	received, ackedRecv uint64
+	unacked             int
+
+	// server only
+	mu         sync.Mutex
+	readerDone chan struct{}
+	expire     *time.Timer
+	resuming   bool
+	dead       bool
+}
+
+func newSession(token string) *session {
+	return &session{token: token, keepBytes: sessionKeep, readerDone: make(chan struct{})}
+}
+
+// keep numbers frames and keeps them until acknowledged, dropping the
+// oldest past sessionKeep bytes. Called holding ws.lock.
+func (s *session) keep(frames []byte) {
+	s.sent++
+	s.buf = append(s.buf, frames)
+	s.bufBytes += len(frames)
+	n := 0
+	for ; s.bufBytes > s.keepBytes && n < len(s.buf)-1; n++ {
+		s.bufBytes -= len(s.buf[n])
+	}
+	s.drop(n)
+}
+
+// trim drops the messages the peer received, false if it claims more than
+// was sent or fewer than it acknowledged. Called holding ws.lock.
+func (s *session) trim(received uint64) bool {
+	if received < s.acked || received > s.sent {
+		return false
+	}
+	s.acked = received
+	if received > s.first {
+		n := int(received - s.first)
+		for _, frames := range s.buf[:n] {
+			s.bufBytes -= len(frames)
+		}
+		s.drop(n)
+	}
+	return true
+}
+
+// drop forgets the n oldest messages kept.
+func (s *session) drop(n int) {
+	for i := 0; i < n; i++ {
+		s.buf[i] = nil
+	}
+	s.buf = s.buf[n:]
+	s.first += uint64(n)
+}
+
+// kept tells whether the messages from next on are all kept, called
+// holding ws.lock.
+func (s *session) kept(next uint64) bool {
+	return next >= s.first
+}
+
+// counted accounts a numbered message of n bytes read, acknowledging
+// every so often.
+func (ws *webSocket) counted(n int) {
+	s := ws.session
+	s.received++
+	s.unacked += n
+	if s.received-s.ackedRecv < ackEvery && s.unacked < ackBytes {
+		return
+	}
+	s.ackedRecv, s.unacked = s.received, 0
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if s.resending {
+		s.ackDue = s.received
+		return
+	}
+	ws.ack(s.received)
+}
+
+// ack sends the count of messages received, called holding ws.lock.
+func (ws *webSocket) ack(received uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, received)
+	_ = ws.writeFrames(appendFrame(nil, wsStream, flagAck, 0, b))
+}
+
+// acknowledged trims what the peer acknowledged from the resend buffer.
+func (ws *webSocket) acknowledged(p []byte) {
+	if ws.session == nil || len(p) < 8 {
+		return
+	}
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if !ws.session.trim(binary.BigEndian.Uint64(p)) {
+		log.Warnf("websocket %v acknowledged messages never sent", u64(ws.id))
+	}
+}
+
+// attach puts conn in place of the connection ws lost, false if the peer
+// missed more than is kept. What it missed is resent before anything else
+// is written, while the caller goes on reading.
+func (ws *webSocket) attach(conn *websocket.Conn, received uint64) bool {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	s := ws.session
+	if wireVersionOf(conn) != ws.version || !s.trim(received) || !s.kept(received) {
+		return false
+	}
+	ws.conn = &wsConn{conn}
+	s.resending = true
+	go ws.resend(ws.conn, received)
+	return true
+}
+
+// resend writes the messages from next on to conn, along with those kept
+// meanwhile, until it caught up. ws.lock is only held between writes, a
+// reader waiting for it would stop the peer's resend in turn.
+func (ws *webSocket) resend(conn *wsConn, next uint64) {
+	s := ws.session
+	for {
+		ws.lock.Lock()
+		if ws.conn != conn {
+			// lost again, the next attach resends
+			ws.lock.Unlock()
+			return
+		}
+		if next < s.acked {
+			next = s.acked
+		}
+		if !s.kept(next) {
+			// dropped while sending the ones before, the peer can not
+			// catch up
+			ws.lock.Unlock()
+			log.Warnf("websocket %v resend: messages no longer kept", u64(ws.id))
+			_ = conn.Close()
+			return
+		}
+		if next == s.sent {
+			s.resending = false
+			if s.ackDue != 0 {
+				ws.ack(s.ackDue)
+				s.ackDue = 0
+			}
+			ws.lock.Unlock()
+			return
+		}
+		frames := s.buf[next-s.first]
+		next++
+		ws.lock.Unlock()
+
+		if err := conn.writeFrames(frames, ws.hashFunc); err != nil {
+			log.Debugf("websocket %v resend: %v", u64(ws.id), err)
+			return
+		}
+	}
+}
+
+// resume dials the server again until it takes the session of ws back or
+// resumeTimeout passes. Called by the reader of ws after cause stopped it.
+func (ws *webSocket) resume(cause error) bool {
+	s := ws.session
+	if s == nil || cause == nil || ws.isClosed() || ws.isRetired() {
+		return false
+	}
+	log.Warnf("websocket connection %v lost, resuming: %v", u64(ws.id), cause)
+	// unblock writers stuck on the connection
+	_ = ws.conn.Close()
+	for deadline := time.Now().Add(resumeTimeout); time.Now().Before(deadline); time.Sleep(time.Second) {
+		// only the server holding the session can resume it
+		conn, resp, err := dialWs(ws.server, http.Header{
+			"Session":          {s.token},
+			"Session-Received": {strconv.FormatUint(s.received, 10)},
+		})
+		serverPool.report(ws.server, err)
+		if err != nil {
+			log.Warnf("resuming websocket %v: %v", u64(ws.id), err)
+			continue
+		}
+		received, err := strconv.ParseUint(resp.Header.Get("Session-Resumed"), 10, 64)
+		if err != nil || !ws.attach(conn, received) {
+			log.Warnf("websocket connection %v could not be resumed", u64(ws.id))
+			_ = conn.Close()
+			return false
+		}
+		ws.startKeepalive()
+		log.Infof("websocket connection %v resumed", u64(ws.id))
+		return true
+	}
+	return false
+}
+
+// suspend keeps the session of ws for the client to resume after its
+// connection failed with err, false if there is nothing to keep. Called by
+// the reader of ws.
+func (ws *webSocket) suspend(err error) bool {
+	s := ws.session
+	if s == nil || err == nil || ws.isClosed() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dead {
+		return false
+	}
+	log.Warnf("websocket connection %v lost, kept for resumption: %v", u64(ws.id), err)
+	ws.expireLater()
+	close(s.readerDone)
+	return true
+}
+
+// expireLater closes ws unless resumed within resumeTimeout, called
+// holding session.mu.
+func (ws *webSocket) expireLater() {
+	s := ws.session
+	s.expire = time.AfterFunc(resumeTimeout, func() {
+		s.mu.Lock()
+		s.dead = true
+		s.mu.Unlock()
+		log.Warnf("websocket connection %v not resumed in time", u64(ws.id))
+		ws.close()
+	})
+}
+
+// takeOver stops the connection of ws for a client resuming, false if the
+// session expired or another resumption is under way.
+func (ws *webSocket) takeOver() bool {
+	s := ws.session
+	s.mu.Lock()
+	if s.dead || s.resuming {
+		s.mu.Unlock()
+		return false
+	}
+	s.resuming = true
+	s.mu.Unlock()
+
+	// the old connection may look alive still
+	_ = ws.conn.Close()
+	<-s.readerDone
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dead || !s.expire.Stop() {
+		s.resuming = false
+		return false
+	}
+	return true
+}
+
+// resumed ends a resumption begun by takeOver, the session running again
+// if ok or else waiting for the next one.
+func (ws *webSocket) resumed(ok bool) {
+	s := ws.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resuming = false
+	if ok {
+		s.readerDone = make(chan struct{})
+	} else {
+		ws.expireLater()
+	}
+}
+
+func (ws *webSocket) isClosed() bool {
+	return atomic.LoadInt32(&ws.closed) != 0
+}
+
+func (ws *webSocket) isRetired() bool {
+	ws.streamLock.Lock()
+	defer ws.streamLock.Unlock()
+	return ws.retired
+}
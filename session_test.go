@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSessionTrim(t *testing.T) {
+	s := newSession("t")
+	for i := 0; i < 5; i++ {
+		s.keep([]byte{byte(i)})
+	}
+	if s.trim(6) {
+		t.Error("acknowledged more than was sent")
+	}
+	if !s.trim(2) || len(s.buf) != 3 || s.buf[0][0] != 2 {
+		t.Fatalf("after trim(2) buf %v, want messages 2 to 4", s.buf)
+	}
+	if s.trim(1) {
+		t.Error("acknowledged fewer than before")
+	}
+	if !s.trim(2) || len(s.buf) != 3 {
+		t.Error("repeated ack changed the buffer")
+	}
+	if !s.trim(5) || len(s.buf) != 0 {
+		t.Errorf("%d messages left after acking all", len(s.buf))
+	}
+}
+
+// TestSessionKeep drops the oldest messages past sessionKeep, a peer that
+// missed them can no longer be caught up.
+func TestSessionKeep(t *testing.T) {
+	s := newSession("t")
+	s.keepBytes = 10
+	for i := 0; i < 5; i++ {
+		s.keep([]byte{byte(i), 0, 0, 0})
+	}
+	if len(s.buf) != 2 || s.bufBytes != 8 || s.buf[0][0] != 3 {
+		t.Fatalf("kept %v, want the newest 2 messages", s.buf)
+	}
+	if s.kept(2) || !s.kept(3) {
+		t.Error("messages dropped taken for kept")
+	}
+	// a late ack of dropped messages is no error
+	if !s.trim(1) || len(s.buf) != 2 {
+		t.Errorf("ack of dropped messages changed the buffer to %v", s.buf)
+	}
+	if !s.trim(4) || len(s.buf) != 1 || s.bufBytes != 4 || !s.kept(4) {
+		t.Errorf("after trim(4) buf %v of %d bytes", s.buf, s.bufBytes)
+	}
+	// one message bigger than the limit is kept still
+	s.keep(make([]byte, 20))
+	if len(s.buf) != 1 || s.first != 5 {
+		t.Errorf("kept %d messages from %d, want the big one alone", len(s.buf), s.first)
+	}
+}
+
+// TestResume cuts the connection of a websocket in the middle of a
+// transfer, which goes on intact once the session is resumed.
+func TestResume(t *testing.T) {
+	ws, conn := startEcho(t)
+	sent := genRandBytes(4 << 20)
+	go writeAll(conn, sent)
+	got, err := readCutting(ws, conn, len(sent)/4)
+	if err != nil || !bytes.Equal(got, sent) {
+		t.Fatalf("%d of %d bytes echoed intact, %v", commonPrefix(got, sent), len(sent), err)
+	}
+	if ws.isClosed() {
+		t.Error("websocket closed instead of resumed")
+	}
+}
+
+// TestResumeFailed cuts the connection of a websocket the server no longer
+// has the session of, its streams end instead of hanging.
+func TestResumeFailed(t *testing.T) {
+	ws, conn := startEcho(t)
+	sessions.Range(func(token, _ interface{}) bool {
+		sessions.Delete(token)
+		return true
+	})
+	sent := genRandBytes(4 << 20)
+	go writeAll(conn, sent)
+	got, err := readCutting(ws, conn, len(sent)/4)
+	if len(got) == len(sent) {
+		t.Fatal("transfer finished over a session that could not resume")
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		t.Fatalf("stream hung after %d bytes", len(got))
+	}
+	if !ws.isClosed() {
+		t.Error("websocket left open")
+	}
+}
+
+// startEcho opens a stream to an echo server, returning the websocket
+// carrying it.
+func startEcho(t *testing.T) (*webSocket, *net.TCPConn) {
+	startServer(t)
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = echo.Close() })
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn := connect(t, echo.Addr().String())
+	t.Cleanup(func() { _ = conn.Close() })
+	v, _ := wsPool.Load(u64(wsKeys[0]))
+	ws := v.(*webSocket)
+	if ws.session == nil {
+		t.Fatal("no session to resume")
+	}
+	return ws, conn
+}
+
+func writeAll(conn *net.TCPConn, p []byte) {
+	for len(p) > 0 {
+		n := 32 * 1024
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := conn.Write(p[:n]); err != nil {
+			return
+		}
+		p = p[n:]
+	}
+	_ = conn.CloseWrite()
+}
+
+// readCutting reads conn to the end, cutting the connection under ws once
+// cut bytes arrived.
+func readCutting(ws *webSocket, conn *net.TCPConn, cut int) ([]byte, error) {
+	var got []byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if cut > 0 && len(got) >= cut {
+			cut = 0
+			ws.lock.Lock()
+			_ = ws.conn.UnderlyingConn().Close()
+			ws.lock.Unlock()
+		}
+		if err == io.EOF {
+			return got, nil
+		}
+		if err != nil {
+			return got, err
+		}
+	}
+}
+
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS4 reply codes.
+const (
+	socks4Granted  = 90
+	socks4Rejected = 91
+)
+
+// maxSocks4Field bounds the NUL terminated USERID and 4a hostname fields.
+const maxSocks4Field = 255
+
+var errSocks4Field = errors.New("socks4 field too long")
+
+// Handshake4 parses a SOCKS4 or SOCKS4a CONNECT request and returns its
+// target as a SOCKS5 address. SOCKS4 carries no password, so requests are
+// refused when authRequired is set.
+func Handshake4(rw io.ReadWriter, authRequired bool) (Addr, error) {
+	// read VN CD DSTPORT DSTIP USERID NULL
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return nil, err
+	}
+	cmd, port, ip := buf[1], buf[2:4], buf[4:8]
+	user, err := readField(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd != CmdConnect {
+		_ = writeReply4(rw, byte(ErrCommandNotSupported))
+		return nil, ErrCommandNotSupported
+	}
+	if authRequired {
+		log.Warnf("socks4 request from user %q refused, authentication required", user)
+		_ = writeReply4(rw, byte(ErrConnectionNotAllowed))
+		return nil, ErrAuthFailed
+	}
+
+	// SOCKS4a: DSTIP 0.0.0.x with x != 0, hostname follows USERID
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readField(rw)
+		if err != nil {
+			return nil, err
+		}
+		addr := ParseAddr(net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+		if addr == nil {
+			_ = writeReply4(rw, byte(ErrAddressNotSupported))
+			return nil, ErrAddressNotSupported
+		}
+		return addr, nil
+	}
+
+	return append(append(Addr{AtypIPv4}, ip...), port...), nil
+}
+
+// readField reads a NUL terminated field byte by byte, so that nothing
+// past the request is consumed from r.
+func readField(r io.Reader) (string, error) {
+	var field []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(field), nil
+		}
+		if len(field) == maxSocks4Field {
+			return "", errSocks4Field
+		}
+		field = append(field, b[0])
+	}
+}
+
+// writeReply4 writes VN CD DSTPORT DSTIP, mapping a SOCKS5 reply code.
+func writeReply4(w io.Writer, rep byte) error {
+	cd := byte(socks4Granted)
+	if rep != 0 {
+		cd = socks4Rejected
+	}
+	_, err := w.Write([]byte{0, cd, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// socks4Conn reads a request and keeps the reply.
+type socks4Conn struct {
+	io.Reader
+	reply bytes.Buffer
+}
+
+func (c *socks4Conn) Write(p []byte) (int, error) { return c.reply.Write(p) }
+
+func TestHandshake4(t *testing.T) {
+	cases := []struct {
+		name string
+		req  string
+		auth bool
+		addr string // empty when refused
+		cd   byte
+	}{
+		{"socks4", "\x04\x01\x00\x50\x0a\x00\x00\x01user\x00", false, "10.0.0.1:80", 0},
+		{"socks4a", "\x04\x01\x01\xbb\x00\x00\x00\x01\x00example.com\x00", false, "example.com:443", 0},
+		{"socks4a ip", "\x04\x01\x00\x50\x00\x00\x00\x07\x00127.0.0.1\x00", false, "127.0.0.1:80", 0},
+		{"bind", "\x04\x02\x00\x50\x0a\x00\x00\x01\x00", false, "", socks4Rejected},
+		{"auth required", "\x04\x01\x00\x50\x0a\x00\x00\x01user\x00", true, "", socks4Rejected},
+	}
+	for _, c := range cases {
+		rw := &socks4Conn{Reader: bytes.NewReader([]byte(c.req + "payload"))}
+		addr, err := Handshake4(rw, c.auth)
+		if c.addr == "" {
+			if err == nil {
+				t.Errorf("%s: accepted as %s", c.name, addr)
+			} else if reply := rw.reply.Bytes(); len(reply) != 8 || reply[1] != c.cd {
+				t.Errorf("%s: reply %x, want code %d", c.name, reply, c.cd)
+			}
+			continue
+		}
+		if err != nil || addr.String() != c.addr {
+			t.Errorf("%s: got %s %v, want %s", c.name, addr, err, c.addr)
+		}
+		// nothing past the request is consumed
+		if rest, _ := ioutil.ReadAll(rw.Reader); string(rest) != "payload" {
+			t.Errorf("%s: left %q after the request", c.name, rest)
+		}
+	}
+
+	long := "\x04\x01\x00\x50\x0a\x00\x00\x01" + string(bytes.Repeat([]byte{'u'}, maxSocks4Field+1)) + "\x00"
+	if _, err := Handshake4(&socks4Conn{Reader: bytes.NewReader([]byte(long))}, false); err != errSocks4Field {
+		t.Errorf("overlong userid: got %v, want %v", err, errSocks4Field)
+	}
+}
+
+// TestSocks4Connect connects with SOCKS4a through the mux and exchanges
+// data after a granted reply.
+func TestSocks4Connect(t *testing.T) {
+	startServer(t)
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		conn, err := dest.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+	port := dest.Addr().(*net.TCPAddr).Port
+
+	conn, err := net.Dial("tcp", startClient(t, new(Client)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// VN CD DSTPORT 0.0.0.1 USERID NULL HOST NULL
+	req := append([]byte{4, CmdConnect, byte(port >> 8), byte(port), 0, 0, 0, 1, 0}, "127.0.0.1\x00ping"...)
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 8)
+	if _, err = io.ReadFull(conn, reply); err != nil || reply[1] != socks4Granted {
+		t.Fatalf("reply %x, want granted: %v", reply, err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo %q %v", buf, err)
+	}
+}
@@ -3,16 +3,26 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"net"
 	"strconv"
+	"syscall"
 )
 
 // SOCKS request commands as defined in RFC 1928 section 4.
 const (
-	CmdConnect = 1
-	//CmdBind         = 2
-	//CmdUDPAssociate = 3
+	CmdConnect      = 1
+	CmdBind         = 2
+	CmdUDPAssociate = 3
+)
+
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	MethodNoAuth       = 0
+	MethodUserPass     = 2
+	MethodNoAcceptable = 0xff
 )
 
 // SOCKS address types as defined in RFC 1928 section 5.
@@ -31,16 +41,19 @@ func (err Error) Error() string {
 
 // SOCKS errors as defined in RFC 1928 section 6.
 const (
-	//ErrGeneralFailure       = Error(1)
-	//ErrConnectionNotAllowed = Error(2)
-	//ErrNetworkUnreachable   = Error(3)
-	//ErrHostUnreachable      = Error(4)
-	//ErrConnectionRefused    = Error(5)
-	//ErrTTLExpired           = Error(6)
-	ErrCommandNotSupported = Error(7)
-	ErrAddressNotSupported = Error(8)
+	ErrGeneralFailure       = Error(1)
+	ErrConnectionNotAllowed = Error(2)
+	ErrNetworkUnreachable   = Error(3)
+	ErrHostUnreachable      = Error(4)
+	ErrConnectionRefused    = Error(5)
+	ErrTTLExpired           = Error(6)
+	ErrCommandNotSupported  = Error(7)
+	ErrAddressNotSupported  = Error(8)
 )
 
+// ErrAuthFailed is returned when the socks peer fails authentication.
+var ErrAuthFailed = errors.New("socks authentication failed")
+
 // MaxAddrLen is the maximum size of SOCKS address in bytes.
 const MaxAddrLen = 1 + 1 + 255 + 2
 
@@ -66,6 +79,71 @@ func (a Addr) String() string {
 	return net.JoinHostPort(host, port)
 }
 
+// SplitAddr slices a SOCKS address from beginning of b. Returns nil if failed.
+func SplitAddr(b []byte) Addr {
+	addrLen := 1
+	if len(b) < addrLen {
+		return nil
+	}
+
+	switch b[0] {
+	case AtypDomainName:
+		if len(b) < 2 {
+			return nil
+		}
+		addrLen = 1 + 1 + int(b[1]) + 2
+	case AtypIPv4:
+		addrLen = 1 + net.IPv4len + 2
+	case AtypIPv6:
+		addrLen = 1 + net.IPv6len + 2
+	default:
+		return nil
+	}
+
+	if len(b) < addrLen {
+		return nil
+	}
+
+	return b[:addrLen]
+}
+
+// ParseAddr parses the address in string s. Returns nil if failed.
+func ParseAddr(s string) Addr {
+	var addr Addr
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			addr = make([]byte, 1+net.IPv4len+2)
+			addr[0] = AtypIPv4
+			copy(addr[1:], ip4)
+		} else {
+			addr = make([]byte, 1+net.IPv6len+2)
+			addr[0] = AtypIPv6
+			copy(addr[1:], ip)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil
+		}
+		addr = make([]byte, 1+1+len(host)+2)
+		addr[0] = AtypDomainName
+		addr[1] = byte(len(host))
+		copy(addr[2:], host)
+	}
+
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil
+	}
+
+	addr[len(addr)-2], addr[len(addr)-1] = byte(portnum>>8), byte(portnum)
+
+	return addr
+}
+
 func readAddr(r io.Reader, b []byte) (Addr, error) {
 	if len(b) < MaxAddrLen {
 		return nil, io.ErrShortBuffer
@@ -94,34 +172,114 @@ func readAddr(r io.Reader, b []byte) (Addr, error) {
 	return nil, ErrAddressNotSupported
 }
 
-// Handshake fast-tracks SOCKS initialization to get target address to connect.
-func Handshake(rw io.ReadWriter) (Addr, error) {
+// Handshake fast-tracks SOCKS initialization to get the requested command and
+// its target address. The final reply is left to the caller, except for
+// unsupported commands. Username/password authentication is required when
+// auth is not nil.
+func Handshake(rw io.ReadWriter, auth *Credentials) (byte, Addr, error) {
 	// Read RFC 1928 for request and reply structure and sizes.
 	buf := make([]byte, MaxAddrLen)
 	// read VER, NMETHODS, METHODS
 	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	nmethods := buf[1]
 	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	// write VER METHOD
-	if _, err := rw.Write([]byte{5, 0}); err != nil {
-		return nil, err
+	method := byte(MethodNoAuth)
+	if auth != nil {
+		method = MethodUserPass
+	}
+	if bytes.IndexByte(buf[:nmethods], method) < 0 {
+		_, _ = rw.Write([]byte{5, MethodNoAcceptable})
+		return 0, nil, ErrAuthFailed
+	}
+	if _, err := rw.Write([]byte{5, method}); err != nil {
+		return 0, nil, err
+	}
+	if auth != nil {
+		if err := authenticate(rw, buf, auth); err != nil {
+			return 0, nil, err
+		}
 	}
 	// read VER CMD RSV ATYP DST.ADDR DST.PORT
 	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
-		return nil, err
-	}
-	if buf[1] != CmdConnect {
-		return nil, ErrCommandNotSupported
+		return 0, nil, err
 	}
+	cmd := buf[1]
 	addr, err := readAddr(rw, buf)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
+	}
+	switch cmd {
+	case CmdConnect, CmdBind, CmdUDPAssociate:
+		return cmd, addr, nil
+	}
+	_ = writeReply(rw, byte(ErrCommandNotSupported), nil)
+	return 0, nil, ErrCommandNotSupported
+}
+
+// replyCode maps a dial error to the closest SOCKS reply code.
+func replyCode(err error) Error {
+	var dnsErr *net.DNSError
+	var sErr Error
+	switch {
+	case errors.As(err, &sErr):
+		return sErr
+	case errors.As(err, &dnsErr):
+		return ErrHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ErrNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ErrHostUnreachable
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return ErrTTLExpired
+	}
+	return ErrGeneralFailure
+}
+
+// authenticate runs the RFC 1929 username/password sub-negotiation.
+func authenticate(rw io.ReadWriter, buf []byte, auth *Credentials) error {
+	// read VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 1 {
+		_, _ = rw.Write([]byte{1, 1})
+		return ErrAuthFailed
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(rw, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return err
+	}
+	pass := make([]byte, buf[0])
+	if _, err := io.ReadFull(rw, pass); err != nil {
+		return err
+	}
+	// write VER STATUS
+	if !auth.Validate(string(user), string(pass)) {
+		_, _ = rw.Write([]byte{1, 1})
+		log.Warnf("socks authentication failed for user %q", user)
+		return ErrAuthFailed
+	}
+	_, err := rw.Write([]byte{1, 0})
+	return err
+}
+
+// writeReply writes VER REP RSV ATYP BND.ADDR BND.PORT, using 0.0.0.0:0
+// when bnd is nil.
+func writeReply(w io.Writer, rep byte, bnd Addr) error {
+	if bnd == nil {
+		bnd = Addr{AtypIPv4, 0, 0, 0, 0, 0, 0}
 	}
-	// write VER REP RSV ATYP BND.ADDR BND.PORT
-	_, err = rw.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
-	return addr, err
+	_, err := w.Write(append([]byte{5, rep, 0}, bnd...))
+	return err
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestReplyCode(t *testing.T) {
+	syscallErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	cases := []struct {
+		err  error
+		want Error
+	}{
+		{ErrConnectionNotAllowed, ErrConnectionNotAllowed},
+		{fmt.Errorf("policy: %w", ErrConnectionNotAllowed), ErrConnectionNotAllowed},
+		{&net.DNSError{Err: "no such host", Name: "nx.invalid"}, ErrHostUnreachable},
+		{syscallErr(syscall.ECONNREFUSED), ErrConnectionRefused},
+		{syscallErr(syscall.ENETUNREACH), ErrNetworkUnreachable},
+		{syscallErr(syscall.EHOSTUNREACH), ErrHostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutErr{}}, ErrTTLExpired},
+		{fmt.Errorf("something else"), ErrGeneralFailure},
+	}
+	for _, c := range cases {
+		if got := replyCode(c.err); got != c.want {
+			t.Errorf("%v: got %d, want %d", c.err, got, c.want)
+		}
+	}
+}
+
+// TestConnectRefused gets the reason a dial failed on the server in the
+// reply to the client.
+func TestConnectRefused(t *testing.T) {
+	startServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	_, rep, _ := socksRequest(t, startClient(t, new(Client)), CmdConnect, addr)
+	if Error(rep) != ErrConnectionRefused {
+		t.Errorf("connect to a closed port replied %d, want %d", rep, ErrConnectionRefused)
+	}
+}
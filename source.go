@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// sourcePool is a set of local addresses outgoing connections leave from,
+// taken in turn among those of the destination's family.
+type sourcePool struct {
+	addrs []net.IP
+	next  uint32
+}
+
+// add takes an address or the name of an interface, which stands for all
+// of its global unicast addresses.
+func (p *sourcePool) add(s string) error {
+	if ip := net.ParseIP(s); ip != nil {
+		p.addrs = append(p.addrs, ip)
+		return nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return fmt.Errorf("source %q is neither an address nor an interface", s)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	n := len(p.addrs)
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			p.addrs = append(p.addrs, ipNet.IP)
+		}
+	}
+	if len(p.addrs) == n {
+		return fmt.Errorf("interface %s has no usable address", s)
+	}
+	return nil
+}
+
+// pick returns the local address for a connection to dst, nil leaves the
+// choice to the system.
+func (p *sourcePool) pick(dst net.IP) *net.TCPAddr {
+	if p == nil || len(p.addrs) == 0 {
+		return nil
+	}
+	v4 := dst.To4() != nil
+	candidates := make([]net.IP, 0, len(p.addrs))
+	for _, ip := range p.addrs {
+		if (ip.To4() != nil) == v4 {
+			candidates = append(candidates, ip)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	return &net.TCPAddr{IP: candidates[int(n)%len(candidates)]}
+}
+
+func parseSources(list []string) (*sourcePool, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	p := new(sourcePool)
+	for _, s := range list {
+		if err := p.add(strings.TrimSpace(s)); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// parseSourceMap reads identity=source pairs, an identity listed several
+// times gets a pool of them.
+func parseSourceMap(pairs []string) (map[string]*sourcePool, error) {
+	m := make(map[string]*sourcePool)
+	for _, pair := range pairs {
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid source mapping %q, expect identity=address", pair)
+		}
+		id := pair[:i]
+		if m[id] == nil {
+			m[id] = new(sourcePool)
+		}
+		if err := m[id].add(strings.TrimSpace(pair[i+1:])); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
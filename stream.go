@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Stream ids are scoped to the websocket carrying them. Over v2 the client
+// opens odd ids and the server even ones, counting up so that no id comes
+// back within a session and late frames of a closed stream never reach a
+// new one; 0 stands for the websocket itself. Over v1 the peer may keep a
+// single pool for all its websockets, as earlier versions do, so ids stay
+// random there and are only kept apart from the streams open on this one.
+
+// firstStreamID is the first id a side opens over v2.
+func firstStreamID(isClient bool) uint32 {
+	if isClient {
+		return 1
+	}
+	return 2
+}
+
+func streamID(id []byte) uint32 {
+	return binary.BigEndian.Uint32(id)
+}
+
+// openStream gives c an id of this side and registers it, false once the
+// ids of the websocket ran out.
+func (ws *webSocket) openStream(c *muxConn) bool {
+	ws.streamLock.Lock()
+	defer ws.streamLock.Unlock()
+	if ws.retired {
+		return false
+	}
+	var id uint32
+	if ws.version >= protocolV2 {
+		if ws.nextID > math.MaxUint32-2 {
+			return false
+		}
+		id = ws.nextID
+		ws.nextID += 2
+	} else {
+		for id == 0 || ws.streams[id] != nil {
+			id = streamID(genRandBytes(connAddrLen))
+		}
+	}
+	c.id = make([]byte, connAddrLen)
+	binary.BigEndian.PutUint32(c.id, id)
+	ws.streams[id] = c
+	return true
+}
+
+// peerStream registers a stream the peer opened, nil if the id is in use
+// or, over v2, not one the peer may open.
+func (ws *webSocket) peerStream(id []byte, pipe bool) *muxConn {
+	n := streamID(id)
+	ws.streamLock.Lock()
+	defer ws.streamLock.Unlock()
+	if n == 0 || ws.streams[n] != nil ||
+		ws.version >= protocolV2 && n%2 == ws.nextID%2 {
+		log.Warnf("stream %x refused, id in use or not the peer's", id)
+		return nil
+	}
+	c := &muxConn{
+		id: append([]byte(nil), id...),
+		ws: ws,
+	}
+	if pipe {
+		c.pipeR, c.pipeW = newPipe()
+	}
+	ws.streams[n] = c
+	return c
+}
+
+func (ws *webSocket) stream(id []byte) (*muxConn, bool) {
+	if len(id) < connAddrLen {
+		return nil, false
+	}
+	ws.streamLock.Lock()
+	defer ws.streamLock.Unlock()
+	c, ok := ws.streams[streamID(id)]
+	return c, ok
+}
+
+// removeStream forgets c, closing a retired websocket left without
+// streams.
+func (ws *webSocket) removeStream(c *muxConn) {
+	ws.streamLock.Lock()
+	if n := streamID(c.id); ws.streams[n] == c {
+		delete(ws.streams, n)
+	}
+	idle := ws.retired && len(ws.streams) == 0
+	ws.streamLock.Unlock()
+	if idle {
+		_ = ws.conn.Close()
+	}
+}
+
+// closeStreams ends every stream of a websocket going away.
+func (ws *webSocket) closeStreams() {
+	ws.streamLock.Lock()
+	streams := ws.streams
+	ws.streams = make(map[uint32]*muxConn)
+	ws.streamLock.Unlock()
+	for _, c := range streams {
+		c.closeStuff()
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamIDs(t *testing.T) {
+	ws := &webSocket{
+		version: protocolV2,
+		flow:    newFlow(),
+		streams: make(map[uint32]*muxConn),
+		nextID:  firstStreamID(true),
+	}
+	a, b := &muxConn{ws: ws}, &muxConn{ws: ws}
+	if !ws.openStream(a) || !ws.openStream(b) {
+		t.Fatal("openStream failed")
+	}
+	if streamID(a.id) != 1 || streamID(b.id) != 3 {
+		t.Fatalf("client ids %x %x, want 1 and 3", a.id, b.id)
+	}
+	if ws.peerStream([]byte{0, 0, 0, 5}, false) != nil {
+		t.Error("peer opened a client id")
+	}
+	if ws.peerStream([]byte{0, 0, 0, 0}, false) != nil {
+		t.Error("peer opened stream 0")
+	}
+	if ws.peerStream([]byte{0, 0, 0, 2}, true) == nil {
+		t.Error("peer could not open 2")
+	}
+	if ws.peerStream([]byte{0, 0, 0, 2}, true) != nil {
+		t.Error("peer opened 2 twice")
+	}
+
+	ws.removeStream(a)
+	if _, ok := ws.stream(a.id); ok {
+		t.Error("stream still found after remove")
+	}
+	c := &muxConn{ws: ws}
+	if !ws.openStream(c) || streamID(c.id) != 5 {
+		t.Fatalf("id after close %x, want 5", c.id)
+	}
+	ws.nextID = math.MaxUint32
+	if ws.openStream(&muxConn{ws: ws}) {
+		t.Error("openStream went past the last id")
+	}
+
+	// v1 ids are random but unique to the websocket
+	ws = &webSocket{
+		version: protocolV1,
+		flow:    newFlow(),
+		streams: make(map[uint32]*muxConn),
+	}
+	for i := 0; i < 1000; i++ {
+		if !ws.openStream(&muxConn{ws: ws}) {
+			t.Fatal("openStream failed")
+		}
+	}
+	if len(ws.streams) != 1000 || ws.streams[0] != nil {
+		t.Errorf("%d v1 streams registered", len(ws.streams))
+	}
+}
+
+// TestHalfClose sends a request over the mux and half-closes, the
+// destination answers once it read to the end and the answer still comes
+// back in full.
+func TestHalfClose(t *testing.T) {
+	startServer(t)
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		conn, err := dest.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := ioutil.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("got "), req...))
+	}()
+
+	conn := connect(t, dest.Addr().String())
+	defer conn.Close()
+	if _, err = conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil || string(resp) != "got request" {
+		t.Errorf("got %q %v, want the whole answer", resp, err)
+	}
+}
+
+// TestHalfCloseV1 ends the stream when the local side finishes on a v1
+// websocket, which has no way to pass a half-close on, rather than
+// waiting for a destination that never closes.
+func TestHalfCloseV1(t *testing.T) {
+	defer func(v int) { wireVersion = v }(wireVersion)
+	wireVersion = protocolV1
+	startServer(t)
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		conn, err := dest.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+
+	conn := connect(t, dest.Addr().String())
+	defer conn.Close()
+	if _, err = conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(conn); err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			t.Fatal("stream left open after the local side finished")
+		}
+	}
+}
+
+// connect opens a stream to addr through the client's socks handling, with
+// a deadline that keeps the test from hanging.
+func connect(t *testing.T, addr string) *net.TCPConn {
+	t.Helper()
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go func() {
+		conn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		tcpConn := conn.(*net.TCPConn)
+		new(Client).connect(&bufConn{TCPConn: tcpConn, r: bufio.NewReader(tcpConn)},
+			ParseAddr(addr), func(rep byte, bnd Addr) error {
+				return writeReply(tcpConn, rep, bnd)
+			})
+	}()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// VER REP RSV BND.ADDR BND.PORT
+	buf := make([]byte, MaxAddrLen)
+	if _, err = io.ReadFull(conn, buf[:3]); err != nil || buf[1] != 0 {
+		_ = conn.Close()
+		t.Fatalf("dial failed: %x %v", buf[:3], err)
+	}
+	if _, err = readAddr(conn, buf); err != nil {
+		_ = conn.Close()
+		t.Fatal(err)
+	}
+	return conn.(*net.TCPConn)
+}
@@ -20,8 +20,17 @@ var transfer, _ = ants.NewPoolWithFunc(500000, func(i interface{}) {
 	pack.ch = make(chan struct{})
 	_ = receiver.Invoke(pack)
 	_, err := io.Copy(pack.muxConn, pack.netConn)
+	if err == nil && pack.muxConn.ws.version < protocolV2 {
+		// v1 can not pass the half-close on, the stream ends here
+		_ = pack.muxConn.pipeW.Close()
+	} else if err == nil {
+		// the other direction goes on until the peer is done too
+		err = pack.muxConn.CloseWrite()
+	}
 	if err != nil {
 		log.Debug("connection copy error: ", err)
+		// stop waiting on the peer, what it sent is still delivered
+		_ = pack.muxConn.pipeW.Close()
 	}
 	<-pack.ch
 	_ = pack.muxConn.Close()
@@ -30,7 +39,16 @@ var transfer, _ = ants.NewPoolWithFunc(500000, func(i interface{}) {
 var receiver, _ = ants.NewPoolWithFunc(500000, func(i interface{}) {
 	pack := i.(*dataPack)
 	defer func() { pack.ch <- struct{}{} }()
-	_, err := io.Copy(pack.netConn, pack.muxConn.pipeR)
+	_, err := io.Copy(pack.netConn, pack.muxConn)
+	if err == nil && pack.muxConn.fin {
+		if cw, ok := pack.netConn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+			return
+		}
+		// nothing to pass the half-close on with, the peer finishing
+		// ends both directions as on v1
+		log.Debugf("connection %x, %T can not half-close, closing it", pack.muxConn.id, pack.netConn)
+	}
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			return // ignore i/o timeout
@@ -42,6 +60,9 @@ var receiver, _ = ants.NewPoolWithFunc(500000, func(i interface{}) {
 
 var wsHandler = func(ws *webSocket) {
 	err := ws.Reader()
+	if ws.suspend(err) {
+		return
+	}
 	ws.close()
 	log.Warnf("websocket connection %v closed", u64(ws.id))
 	if err != nil {
@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which
+// shares its value with IP6T_SO_ORIGINAL_DST.
+const soOriginalDst = 80
+
+// originalDst reads the pre-REDIRECT destination of conn from conntrack.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var sysErr error
+	err = raw.Control(func(fd uintptr) {
+		if conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil {
+			addr, sysErr = originalDst6(int(fd))
+			return
+		}
+		addr, sysErr = originalDst4(int(fd))
+		if sysErr == nil {
+			return
+		}
+		// ipv4 on a dual stack socket: its address is ipv4 mapped, ask
+		// at the ipv6 level if the ipv4 one refused
+		if sa, err := unix.Getsockname(int(fd)); err == nil {
+			if _, ok := sa.(*unix.SockaddrInet6); ok {
+				addr, sysErr = originalDst6(int(fd))
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sysErr
+}
+
+func originalDst4(fd int) (*net.TCPAddr, error) {
+	// sockaddr_in fits in the 16 byte multiaddr of ipv6_mreq
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	b := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+		Port: int(b[2])<<8 | int(b[3]),
+	}, nil
+}
+
+func originalDst6(fd int) (*net.TCPAddr, error) {
+	// sockaddr_in6 heads ip6_mtuinfo
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	return &net.TCPAddr{
+		IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+		Port: int(port[0])<<8 | int(port[1]),
+	}, nil
+}
+
+// tproxyListen opens a listener with IP_TRANSPARENT set, so that it
+// accepts connections steered to it by the TPROXY target.
+func tproxyListen(addr *net.TCPAddr) (*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sysErr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					sysErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+					// dual stack sockets also take redirected ipv4
+					_ = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+					return
+				}
+				sysErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sysErr
+		},
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
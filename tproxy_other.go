@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparent = errors.New("transparent proxy is only supported on linux")
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errTransparent
+}
+
+func tproxyListen(addr *net.TCPAddr) (*net.TCPListener, error) {
+	return nil, errTransparent
+}
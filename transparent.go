@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+)
+
+func (client *Client) listenRedirect() {
+	listener, err := net.ListenTCP("tcp", client.RedirectAddr)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	log.Infof("Redirect listening at %s", client.RedirectAddr.String())
+
+	client.serve(listener, func(conn *net.TCPConn) {
+		client.handleTransparent(conn, false)
+	})
+}
+
+func (client *Client) listenTProxy() {
+	listener, err := tproxyListen(client.TProxyAddr)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	log.Infof("TProxy listening at %s", client.TProxyAddr.String())
+
+	client.serve(listener, func(conn *net.TCPConn) {
+		client.handleTransparent(conn, true)
+	})
+}
+
+// handleTransparent relays a connection steered to us by iptables. With
+// REDIRECT the destination comes from conntrack, with TPROXY the socket is
+// bound to the original destination already.
+func (client *Client) handleTransparent(tcpConn *net.TCPConn, tproxy bool) {
+	err := tcpConn.SetLinger(0)
+	if err != nil {
+		_ = tcpConn.Close()
+		return
+	}
+
+	local := tcpConn.LocalAddr().(*net.TCPAddr)
+	dst := local
+	if !tproxy {
+		dst, err = originalDst(tcpConn)
+		if err != nil {
+			log.Debug("original destination error: ", err)
+			_ = tcpConn.Close()
+			return
+		}
+	} else {
+		local = client.TProxyAddr
+	}
+	if redirectLoop(dst, local) {
+		log.Warnf("connection from %v was not redirected, denied", tcpConn.RemoteAddr())
+		_ = tcpConn.Close()
+		return
+	}
+
+	addr := ParseAddr(dst.String())
+	log.Debugln(addr.String())
+	conn := &bufConn{TCPConn: tcpConn, r: bufio.NewReader(tcpConn), redirected: true}
+	// the peer believes it talks to dst directly, nothing to reply
+	client.connect(conn, addr, func(byte, Addr) error {
+		return nil
+	})
+}
+
+// redirectLoop tells a connection made straight to the listener at local,
+// relaying it would loop back to the listener.
+func redirectLoop(dst, local *net.TCPAddr) bool {
+	return dst.Port == local.Port && (dst.IP.Equal(local.IP) || dst.IP.IsLoopback())
+}
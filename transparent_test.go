@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRedirectLoop(t *testing.T) {
+	addr := func(s string) *net.TCPAddr {
+		a, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	cases := []struct {
+		dst, local string
+		loop       bool
+	}{
+		{"127.0.0.1:1080", "127.0.0.1:1080", true},
+		{"192.0.2.1:1080", "192.0.2.1:1080", true},
+		{"127.0.0.2:1080", "0.0.0.0:1080", true},
+		{"[::1]:1080", "[::]:1080", true},
+		{"192.0.2.1:1080", "0.0.0.0:1080", false},
+		{"127.0.0.1:80", "127.0.0.1:1080", false},
+		{"198.51.100.7:443", "192.0.2.1:1080", false},
+	}
+	for _, c := range cases {
+		if got := redirectLoop(addr(c.dst), addr(c.local)); got != c.loop {
+			t.Errorf("dst %s, listener %s: loop %v, want %v", c.dst, c.local, got, c.loop)
+		}
+	}
+}
+
+// TestTransparentLoop closes a connection made to the tproxy listener
+// itself instead of relaying it back there.
+func TestTransparentLoop(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client := &Client{TProxyAddr: ln.Addr().(*net.TCPAddr)}
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		client.handleTransparent(conn, true)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		// reset before the dial returned
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read data from a looping connection")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("looping connection left open")
+	}
+}
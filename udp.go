@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const udpBufSize = 64 * 1024
+
+// udpAssoc is the packet side of a UDP ASSOCIATE stream. On the client it
+// holds the socket exposed to the socks peer, on the server the socket used
+// to reach destinations. Datagrams on the stream carry a SOCKS address
+// followed by the payload.
+type udpAssoc struct {
+	conn       *net.UDPConn
+	peer       atomic.Value // *net.UDPAddr, client only
+	inbound    bool
+	policy     *Policy      // server only
+	resolver   *dnsResolver // server only
+	family     string       // server only, the destinations the socket reaches
+	lastActive int64
+}
+
+func (u *udpAssoc) touch() {
+	atomic.StoreInt64(&u.lastActive, time.Now().UnixNano())
+}
+
+func (u *udpAssoc) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&u.lastActive)))
+}
+
+func (c *muxConn) associate() (n int, err error) {
+	n, err = c.send(c.id, flagAssociate, nil)
+	return
+}
+
+// deliver handles a datagram frame received from the websocket.
+func (u *udpAssoc) deliver(p []byte) {
+	u.touch()
+	if u.inbound {
+		peer, ok := u.peer.Load().(*net.UDPAddr)
+		if !ok {
+			return
+		}
+		// RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA
+		_, err := u.conn.WriteToUDP(append([]byte{0, 0, 0}, p...), peer)
+		if err != nil {
+			log.Debug("udp write error: ", err)
+		}
+		return
+	}
+
+	addr := SplitAddr(p)
+	if addr == nil {
+		log.Debugf("udp datagram with invalid address dropped")
+		return
+	}
+	if addr[0] == AtypDomainName {
+		// resolving may block, keep the websocket reader going
+		p = append([]byte(nil), p...)
+		go u.writeTo(Addr(p[:len(addr)]), p[len(addr):])
+		return
+	}
+	u.writeTo(addr, p[len(addr):])
+}
+
+func (u *udpAssoc) writeTo(addr Addr, p []byte) {
+	host, port, _ := net.SplitHostPort(addr.String())
+	portNum, _ := strconv.Atoi(port)
+	if err := u.policy.checkHost(host, portNum); err != nil {
+		log.Warnf("udp datagram to %s denied: %v", addr, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	ips, err := u.resolver.lookup(ctx, host)
+	if err != nil || len(ips) == 0 {
+		log.Debug("udp resolve error: ", err)
+		return
+	}
+	// like net.ResolveUDPAddr, prefer IPv4
+	if ips = sortAddrs(ips, u.family); len(ips) == 0 {
+		log.Debugf("udp datagram to %s dropped, no %s address", addr, u.family)
+		return
+	}
+	udpAddr := &net.UDPAddr{IP: ips[0], Port: portNum}
+	if err := u.policy.checkIP(udpAddr.IP); err != nil {
+		log.Warnf("udp datagram to %s denied: %v", addr, err)
+		return
+	}
+	_, err = u.conn.WriteToUDP(p, udpAddr)
+	if err != nil {
+		log.Debug("udp write error: ", err)
+	}
+}
+
+func (client *Client) handleAssociate(conn *bufConn) {
+	// bind on the same interface the socks peer reached us at
+	local := conn.LocalAddr().(*net.TCPAddr)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		log.Warn("udp listen error: ", err)
+		_ = writeReply(conn, byte(ErrGeneralFailure), nil)
+		_ = conn.Close()
+		return
+	}
+
+	c := createConn(conn)
+	c.udp = &udpAssoc{conn: udpConn, inbound: true}
+	_, err = c.associate()
+	if err != nil {
+		_ = writeReply(conn, byte(ErrGeneralFailure), nil)
+		_ = c.Close()
+		return
+	}
+
+	err = writeReply(conn, 0, ParseAddr(udpConn.LocalAddr().String()))
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+
+	go client.udpReader(c, conn.RemoteAddr().(*net.TCPAddr).IP)
+
+	// the association terminates when the control connection does
+	_, _ = io.Copy(ioutil.Discard, conn)
+	_ = c.Close()
+}
+
+func (client *Client) udpReader(c *muxConn, owner net.IP) {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, src, err := c.udp.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// only the socks peer owning the association may use it
+		if !src.IP.Equal(owner) {
+			continue
+		}
+		// RSV RSV FRAG, fragmentation is not supported
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		if SplitAddr(buf[3:n]) == nil {
+			continue
+		}
+		c.udp.peer.Store(src)
+		c.udp.touch()
+		_, err = c.send(c.id, flagDatagram, buf[3:n])
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+func (server *Server) associateHandler(c *muxConn) {
+	log.Debugf("connection %x, udp associate", c.id)
+	buf := make([]byte, udpBufSize)
+	for {
+		// without an idle timeout the association lasts as long as its stream
+		var deadline time.Time
+		if server.UDPTimeout > 0 {
+			deadline = time.Now().Add(server.UDPTimeout - c.udp.idle())
+		}
+		err := c.udp.conn.SetReadDeadline(deadline)
+		if err != nil {
+			break
+		}
+		n, src, err := c.udp.conn.ReadFromUDP(buf)
+		if err != nil {
+			// datagrams from the client also keep the association alive
+			if err, ok := err.(net.Error); ok && err.Timeout() && c.udp.idle() < server.UDPTimeout {
+				continue
+			}
+			break
+		}
+		c.udp.touch()
+		_, err = c.send(c.id, flagDatagram, append(ParseAddr(src.String()), buf[:n]...))
+		if err != nil {
+			break
+		}
+	}
+	log.Debugf("connection %x, udp associate expired", c.id)
+	_ = c.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startClient serves the socks port of client until the test ends,
+// returning its address.
+func startClient(t *testing.T, client *Client) string {
+	t.Helper()
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go client.handleConn(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// socksRequest sends a socks5 request of cmd for addr to the client at
+// proxy without authentication, returning the connection and the reply.
+func socksRequest(t *testing.T, proxy string, cmd byte, addr string) (net.Conn, byte, Addr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, MaxAddrLen)
+	// VER NMETHODS METHODS, then VER METHOD
+	if _, err = conn.Write([]byte{5, 1, MethodNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil || buf[1] != MethodNoAuth {
+		t.Fatalf("method %x refused: %v", buf[:2], err)
+	}
+	rep, bnd := socksCommand(t, conn, cmd, addr)
+	return conn, rep, bnd
+}
+
+// socksCommand sends VER CMD RSV DST.ADDR DST.PORT and reads the reply.
+func socksCommand(t *testing.T, conn net.Conn, cmd byte, addr string) (byte, Addr) {
+	t.Helper()
+	if _, err := conn.Write(append([]byte{5, cmd, 0}, ParseAddr(addr)...)); err != nil {
+		t.Fatal(err)
+	}
+	return readReply(t, conn)
+}
+
+// readReply reads VER REP RSV BND.ADDR BND.PORT.
+func readReply(t *testing.T, conn net.Conn) (byte, Addr) {
+	t.Helper()
+	buf := make([]byte, MaxAddrLen)
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		t.Fatalf("no reply: %v", err)
+	}
+	rep := buf[1]
+	bnd, err := readAddr(conn, buf)
+	if err != nil {
+		t.Fatalf("reply address: %v", err)
+	}
+	return rep, append(Addr(nil), bnd...)
+}
+
+// TestUDPAssociate sends a datagram through the mux to an echo server and
+// gets the answer back with the echo server as its source.
+func TestUDPAssociate(t *testing.T) {
+	startServer(t)
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, src, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], src)
+		}
+	}()
+
+	_, rep, bnd := socksRequest(t, startClient(t, new(Client)), CmdUDPAssociate, "0.0.0.0:0")
+	if rep != 0 {
+		t.Fatalf("associate refused with %d", rep)
+	}
+	relay, err := net.ResolveUDPAddr("udp", bnd.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	dst := ParseAddr(echo.LocalAddr().String())
+	// RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA
+	if _, err = conn.Write(append(append([]byte{0, 0, 0}, dst...), "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, udpBufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{0, 0, 0}, dst...), "hello"...)
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("got %x, want %x", buf[:n], want)
+	}
+}
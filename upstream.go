@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	balanceRoundRobin    = "round-robin"
+	balanceLeastLatency  = "least-latency"
+	balancePrimaryBackup = "primary-backup"
+
+	healthInterval = 10 * time.Second
+	// healthFailures in a row take a server out
+	healthFailures = 3
+)
+
+// upstream is one websocket server the client may connect to.
+type upstream struct {
+	url    string
+	host   string
+	weight int
+	// current is the smooth weighted round-robin counter
+	current int
+	// rtt is the last smoothed rtt of a websocket to the server
+	rtt   time.Duration
+	fails int
+	down  bool
+}
+
+// upstreams spreads websockets over the servers given to the client. A
+// server is taken out after healthFailures failed dials, health checks or
+// keepalives in a row, and put back by the next dial or health check that
+// reaches it; while every server is out they are all tried.
+type upstreams struct {
+	sync.Mutex
+	list    []*upstream
+	balance string
+}
+
+// parseUpstreams reads server links, each optionally followed by its
+// weight as a fragment, e.g. wss://a.example/ws#3.
+func parseUpstreams(links []string, balance string) (*upstreams, error) {
+	switch balance {
+	case balanceRoundRobin, balanceLeastLatency, balancePrimaryBackup:
+	default:
+		return nil, fmt.Errorf("unknown balance policy %q", balance)
+	}
+	s := &upstreams{balance: balance}
+	for _, link := range links {
+		u, err := url.Parse(strings.TrimSpace(link))
+		if err != nil {
+			return nil, err
+		}
+		up := &upstream{weight: 1, host: u.Host}
+		if u.Fragment != "" {
+			up.weight, err = strconv.Atoi(u.Fragment)
+			if err != nil || up.weight < 1 {
+				return nil, fmt.Errorf("invalid weight in %q", link)
+			}
+			u.Fragment = ""
+		}
+		if u.Port() == "" {
+			if u.Scheme == "wss" {
+				up.host = net.JoinHostPort(u.Hostname(), "443")
+			} else {
+				up.host = net.JoinHostPort(u.Hostname(), "80")
+			}
+		}
+		up.url = u.String()
+		s.list = append(s.list, up)
+	}
+	if len(s.list) == 0 {
+		return nil, fmt.Errorf("no server given")
+	}
+	return s, nil
+}
+
+// pick chooses the server for a new websocket.
+func (s *upstreams) pick() *upstream {
+	s.Lock()
+	defer s.Unlock()
+	candidates := make([]*upstream, 0, len(s.list))
+	for _, up := range s.list {
+		if !up.down {
+			candidates = append(candidates, up)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = s.list
+	}
+
+	switch s.balance {
+	case balancePrimaryBackup:
+		return candidates[0]
+	case balanceLeastLatency:
+		best := candidates[0]
+		for _, up := range candidates[1:] {
+			// servers not measured yet are tried first
+			if up.rtt < best.rtt {
+				best = up
+			}
+		}
+		return best
+	}
+	var best *upstream
+	total := 0
+	for _, up := range candidates {
+		up.current += up.weight
+		total += up.weight
+		if best == nil || up.current > best.current {
+			best = up
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// report records the outcome of a dial, health check or keepalive. It
+// returns true when that took the server out.
+func (s *upstreams) report(up *upstream, err error) bool {
+	s.Lock()
+	wasDown := up.down
+	if err != nil {
+		up.fails++
+		up.down = wasDown || up.fails >= healthFailures
+	} else {
+		up.fails, up.down = 0, false
+	}
+	down := up.down
+	s.Unlock()
+
+	if down && !wasDown {
+		log.Warnf("server %s taken out: %v", up.url, err)
+	} else if err == nil && wasDown {
+		log.Infof("server %s is back", up.url)
+	}
+	return down && !wasDown
+}
+
+// measured records the smoothed rtt of a websocket to up.
+func (s *upstreams) measured(up *upstream, rtt time.Duration) {
+	s.Lock()
+	up.rtt = rtt
+	s.Unlock()
+}
+
+// check probes the servers periodically, retiring the websockets of
+// servers taken out, so that they are neither resumed nor used for new
+// streams. Servers with a websocket answering keepalives are known to be
+// up and left alone.
+func (s *upstreams) check() {
+	for {
+		for _, up := range s.list {
+			if live(up) {
+				continue
+			}
+			if s.report(up, probe(up)) {
+				wsPool.Range(func(_, v interface{}) bool {
+					if ws := v.(*webSocket); ws.server == up {
+						wsPool.retire(ws)
+						// the reader fails and cleans up
+						_ = ws.conn.Close()
+					}
+					return true
+				})
+			}
+		}
+		time.Sleep(healthInterval)
+	}
+}
+
+// live tells whether a websocket to up is open and has had a keepalive
+// answered.
+func live(up *upstream) (ok bool) {
+	wsPool.Range(func(_, v interface{}) bool {
+		ws := v.(*webSocket)
+		ok = ws.server == up && !ws.isClosed() && ws.RTT() > 0
+		return !ok
+	})
+	return
+}
+
+// probe opens and closes a websocket to up. Unlike a bare connect, it
+// fails when a proxy or CDN in front of the server can not reach it.
+func probe(up *upstream) error {
+	conn, _, err := dialWs(up, http.Header{})
+	if err != nil {
+		return err
+	}
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return conn.Close()
+}
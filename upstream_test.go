@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamsPick(t *testing.T) {
+	links := []string{"ws://a:1/ws#3", "ws://b:1/ws", "wss://c/ws"}
+	s, err := parseUpstreams(links, balanceRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.list[2].host != "c:443" || s.list[0].url != "ws://a:1/ws" {
+		t.Fatalf("unexpected parse result %+v", s.list)
+	}
+	count := map[string]int{}
+	for i := 0; i < 50; i++ {
+		count[s.pick().host]++
+	}
+	if count["a:1"] != 30 || count["b:1"] != 10 || count["c:443"] != 10 {
+		t.Errorf("unexpected round-robin spread %v", count)
+	}
+
+	for i := 1; i < healthFailures; i++ {
+		s.report(s.list[0], errors.New("refused"))
+	}
+	if s.list[0].down {
+		t.Fatal("server taken out before healthFailures")
+	}
+	if !s.report(s.list[0], errors.New("refused")) {
+		t.Fatal("server not taken out after healthFailures")
+	}
+	s.measured(s.list[0], time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if s.pick() == s.list[0] {
+			t.Fatal("server taken out was picked")
+		}
+	}
+
+	s.balance = balancePrimaryBackup
+	if up := s.pick(); up != s.list[1] {
+		t.Errorf("expect the first backup, got %s", up.url)
+	}
+	s.report(s.list[0], nil)
+	if up := s.pick(); up != s.list[0] {
+		t.Errorf("expect the primary back, got %s", up.url)
+	}
+
+	s.balance = balanceLeastLatency
+	s.measured(s.list[1], 5*time.Millisecond)
+	s.measured(s.list[2], 500*time.Microsecond)
+	if up := s.pick(); up != s.list[2] {
+		t.Errorf("expect the fastest, got %s", up.url)
+	}
+
+	for _, bad := range [][]string{{"ws://a/ws#0"}, {"ws://a/ws#x"}, nil} {
+		if _, err := parseUpstreams(bad, balanceRoundRobin); err == nil {
+			t.Errorf("%q: expect error", bad)
+		}
+	}
+	if _, err := parseUpstreams(links, "random"); err == nil {
+		t.Error("expect unknown policy error")
+	}
+}
+
+// TestProbe opens a websocket to a server, which a plain web server in its
+// place, as a CDN without its origin, can not fake.
+func TestProbe(t *testing.T) {
+	startServer(t)
+	if err := probe(serverPool.list[0]); err != nil {
+		t.Errorf("probe of a server failed: %v", err)
+	}
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer web.Close()
+	up := &upstream{url: "ws" + strings.TrimPrefix(web.URL, "http")}
+	if err := probe(up); err == nil {
+		t.Error("probe of a plain web server succeeded")
+	}
+}
+
+// TestLive spares a server the probe once a websocket to it has a
+// keepalive answered.
+func TestLive(t *testing.T) {
+	startServer(t)
+	up := serverPool.list[0]
+	if live(up) {
+		t.Fatal("live without a websocket")
+	}
+	ws := wsPool.get(wsKeys[0])
+	if live(up) {
+		t.Error("live before a keepalive was answered")
+	}
+	ws.sample(time.Millisecond)
+	if !live(up) {
+		t.Error("not live with a measured websocket")
+	}
+	ws.close()
+	if live(up) {
+		t.Error("live after its websocket closed")
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"io"
+	"net"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,13 +19,30 @@ type wsConn struct {
 }
 
 type webSocket struct {
+	srtt     int64 // atomic, first for alignment
 	hashFunc func(b []byte, seed uint64) []byte
 	conn     *wsConn
 	lock     sync.Mutex
 	id       []byte
+	server   *upstream // client only
+	identity string    // server only
+	version  int       // frame protocol agreed on
+	flow     *flow
+	timeout  time.Duration // of keepalive
+	session  *session      // v2 only
 	buf      *bytes.Buffer
 	b        []byte
-	closed   bool
+	closed   int32 // atomic
+
+	streamLock sync.Mutex
+	streams    map[uint32]*muxConn
+	nextID     uint32 // next stream id this side opens over v2
+	retired    bool   // no new streams, see wPool.retire
+
+	// frames waiting to be coalesced, guarded by lock
+	pending    []byte
+	flushTimer *time.Timer
+	writeErr   error // frames reported written were lost, without session
 }
 
 const (
@@ -39,86 +59,250 @@ var (
 	flagClose = []byte("2")
 	flagLoop  = []byte("3")
 
+	flagAssociate = []byte("4")
+	flagDatagram  = []byte("5")
+	flagReply     = []byte("6")
+	flagBind      = []byte("7")
+	flagListen    = []byte("8")
+	flagAccept    = []byte("9")
+	flagQuery     = []byte("a")
+	flagFin       = []byte("c")
+
 	wsKeys     [][]byte
 	wsLen      int
-	mainServer string
+	serverPool *upstreams
+	identity   string
+	// wireVersion is the highest frame protocol the client offers
+	wireVersion = protocolV2
 )
 
 func (ws *webSocket) Reader() (err error) {
-	addressBuf := make([]byte, connAddrLen)
-	hashBuf := make([]byte, digit)
-	controlBuf := make([]byte, 1)
-	var dataBuf []byte
 	for {
 		err = ws.Read()
 		if err != nil {
 			return
 		}
-		if ws.buf.Len() < connAddrLen+digit {
-			log.Warnf("illegal connection %v <-> %v, denied.", ws.conn.LocalAddr(), ws.conn.RemoteAddr())
+		if ws.version < protocolV2 {
+			err = ws.readV1()
+		} else {
+			err = ws.readV2()
+		}
+		if err != nil {
+			log.Warnf("%v %v <-> %v, denied.", err, ws.conn.LocalAddr(), ws.conn.RemoteAddr())
 			_ = ws.conn.Close()
-			return
+			return nil
 		}
+	}
+}
 
-		copy(addressBuf, ws.b)
-		copy(controlBuf, ws.b[connAddrLen:])
-		copy(hashBuf, ws.b[len(ws.b)-digit:])
-		dataBuf = ws.b[connAddrLen+1 : len(ws.b)-digit]
+func (ws *webSocket) readV1() error {
+	if len(ws.b) < connAddrLen+1+digit {
+		return errFrame
+	}
+	dataBuf := ws.b[connAddrLen+1 : len(ws.b)-digit]
+	// verify hmacBlock
+	if !validateCode(dataBuf, ws.b[len(ws.b)-digit:], ws.hashFunc) {
+		return errFrameHash
+	}
+	atomic.AddInt64(&downloaded, int64(len(ws.b)))
+	ws.handle(ws.b[:connAddrLen], ws.b[connAddrLen:connAddrLen+1], 0, dataBuf)
+	return nil
+}
 
-		log.Debugf("frame %x received, len %v", addressBuf, len(dataBuf))
-		// verify hmacBlock
-		if !validateCode(dataBuf, hashBuf, ws.hashFunc) {
-			log.Warnf("invalid hash %v <-> %v, denied.", ws.conn.LocalAddr(), ws.conn.RemoteAddr())
-			_ = ws.conn.Close()
-			return
+func (ws *webSocket) readV2() error {
+	if len(ws.b) < frameHeaderLen+digit {
+		return errFrame
+	}
+	frames := ws.b[:len(ws.b)-digit]
+	if !validateCode(frames, ws.b[len(ws.b)-digit:], ws.hashFunc) {
+		return errFrameHash
+	}
+	atomic.AddInt64(&downloaded, int64(len(ws.b)))
+	numbered := ws.session != nil && frames[1] != frameType(flagAck)
+	for len(frames) > 0 {
+		id, flag, flags, p, rest, err := splitFrame(frames)
+		if err != nil {
+			return err
 		}
-		atomic.AddInt64(&downloaded, int64(len(ws.b)))
-		if bytes.Equal(controlBuf, flagData) {
-			if c, ok := connPool.Load(u32(addressBuf)); ok {
-				log.Debugf("data frame %x accepted", addressBuf)
-				c := c.(*muxConn)
-				_, err = c.pipeW.Write(dataBuf)
-				if err != nil {
-					_ = c.Close()
+		ws.handle(id, flag, flags, p)
+		frames = rest
+	}
+	if numbered {
+		ws.counted(len(ws.b))
+	}
+	return nil
+}
+
+// handle dispatches a frame received, flags being those of its v2 header.
+// The buffers are only valid until it returns.
+func (ws *webSocket) handle(addressBuf, controlBuf []byte, flags uint16, dataBuf []byte) {
+	log.Debugf("frame %x received, len %v", addressBuf, len(dataBuf))
+	if bytes.Equal(controlBuf, flagData) {
+		if c, ok := ws.stream(addressBuf); ok {
+			log.Debugf("data frame %x accepted", addressBuf)
+			if ws.version >= protocolV2 && !ws.received(c, len(dataBuf)) {
+				log.Warnf("data frame %x overran its window", addressBuf)
+				_ = c.Close()
+				return
+			}
+			if _, err := c.pipeW.Write(dataBuf); err != nil {
+				_ = c.Close()
+			}
+		} else {
+			log.Debugf("data frame %x accepted, but conn not found", addressBuf)
+			if ws.version >= protocolV2 {
+				// still counts against the websocket window
+				if !ws.received(nil, len(dataBuf)) {
+					log.Warnf("data frame %x overran the websocket window", addressBuf)
 				}
-			} else {
-				log.Debugf("data frame %x accepted, but conn not found", addressBuf)
-				_, _ = ws.writeData(addressBuf, flagClose, nil)
+				ws.consumed(nil, len(dataBuf))
 			}
-		} else if bytes.Equal(controlBuf, flagDial) {
-			// server only
-			log.Debugf("dial frame %x accepted", addressBuf)
-			c := &muxConn{
-				id: addressBuf,
-				ws: ws,
+			_, _ = ws.writeData(addressBuf, flagClose, nil)
+		}
+	} else if bytes.Equal(controlBuf, flagDial) {
+		// server only
+		log.Debugf("dial frame %x accepted", addressBuf)
+		c := ws.peerStream(addressBuf, true)
+		if c == nil {
+			return
+		}
+		c.noDelay = flags&frameNoDelay != 0
+		host := string(dataBuf)
+		go server.dialHandler(host, c)
+	} else if bytes.Equal(controlBuf, flagBind) {
+		// server only
+		log.Debugf("bind frame %x accepted", addressBuf)
+		c := ws.peerStream(addressBuf, true)
+		if c == nil {
+			return
+		}
+		host := string(dataBuf)
+		go server.bindHandler(host, c)
+	} else if bytes.Equal(controlBuf, flagListen) {
+		// server only
+		log.Debugf("listen frame %x accepted", addressBuf)
+		c := ws.peerStream(addressBuf, false)
+		if c == nil {
+			return
+		}
+		host := string(dataBuf)
+		go server.listenHandler(host, c)
+	} else if bytes.Equal(controlBuf, flagAccept) {
+		// client only
+		l, ok := ws.stream(dataBuf)
+		if !ok || l.target == "" {
+			log.Debugf("accept frame %x accepted, but listener not found", addressBuf)
+			_, _ = ws.writeData(addressBuf, flagClose, nil)
+			return
+		}
+		log.Debugf("accept frame %x accepted", addressBuf)
+		c := ws.peerStream(addressBuf, true)
+		if c == nil {
+			return
+		}
+		go client.acceptHandler(l.target, c)
+	} else if bytes.Equal(controlBuf, flagQuery) {
+		// server only
+		log.Debugf("query frame %x accepted", addressBuf)
+		c := ws.peerStream(addressBuf, false)
+		if c == nil {
+			return
+		}
+		go server.dnsHandler(append([]byte(nil), dataBuf...), c)
+	} else if bytes.Equal(controlBuf, flagReply) {
+		// client only
+		if c, ok := ws.stream(addressBuf); ok && c.replies != nil {
+			log.Debugf("reply frame %x accepted", addressBuf)
+			select {
+			case c.replies <- append([]byte(nil), dataBuf...):
+			default:
 			}
-			c.pipeR, c.pipeW = newPipe()
-			// wait until dial finish
-			connPool.Store(u32(addressBuf), c)
-			host := string(dataBuf)
-			go server.dialHandler(host, c)
-		} else if bytes.Equal(controlBuf, flagClose) {
-			if s, ok := connPool.Load(u32(addressBuf)); ok {
-				log.Debugf("close frame %x accepted", addressBuf)
-				connPool.Delete(u32(addressBuf))
-				s.(*muxConn).closeStuff()
+		} else {
+			log.Debugf("reply frame %x accepted, but conn not found", addressBuf)
+		}
+	} else if bytes.Equal(controlBuf, flagAssociate) {
+		// server only
+		log.Debugf("associate frame %x accepted", addressBuf)
+		c := ws.peerStream(addressBuf, false)
+		if c == nil {
+			return
+		}
+		// one socket serves all destinations, so with a source address it
+		// only reaches those of its family, IPv4 taken first
+		var local *net.UDPAddr
+		family := familyIPv4First
+		if addr, ok := server.source(ws, net.IPv4zero).(*net.TCPAddr); ok {
+			local, family = &net.UDPAddr{IP: addr.IP}, familyIPv4Only
+		} else if addr, ok := server.source(ws, net.IPv6unspecified).(*net.TCPAddr); ok {
+			local, family = &net.UDPAddr{IP: addr.IP}, familyIPv6Only
+		}
+		udpConn, err := net.ListenUDP("udp", local)
+		if err != nil {
+			log.Warn("udp listen error: ", err)
+			ws.removeStream(c)
+			_, _ = ws.writeData(addressBuf, flagClose, nil)
+			return
+		}
+		c.udp = &udpAssoc{conn: udpConn, policy: server.Policy, resolver: server.DNS, family: family}
+		c.udp.touch()
+		go server.associateHandler(c)
+	} else if bytes.Equal(controlBuf, flagDatagram) {
+		if c, ok := ws.stream(addressBuf); ok && c.udp != nil {
+			c.udp.deliver(dataBuf)
+		} else {
+			log.Debugf("datagram frame %x accepted, but association not found", addressBuf)
+		}
+	} else if bytes.Equal(controlBuf, flagClose) {
+		if s, ok := ws.stream(addressBuf); ok {
+			log.Debugf("close frame %x accepted", addressBuf)
+			ws.removeStream(s)
+			if s.fin && s.localConn() != nil {
+				s.finish()
 			} else {
-				log.Debugf("close frame %x accepted, but conn not found", addressBuf)
+				s.closeStuff()
 			}
-		} else if bytes.Equal(controlBuf, flagLoop) {
-			_, _ = ws.writeData(addressBuf, flagClose, dataBuf)
 		} else {
-			log.Warnf("unknown flag: %x", addressBuf)
+			log.Debugf("close frame %x accepted, but conn not found", addressBuf)
+		}
+	} else if bytes.Equal(controlBuf, flagFin) {
+		if c, ok := ws.stream(addressBuf); ok && c.pipeW != nil {
+			log.Debugf("fin frame %x accepted", addressBuf)
+			c.fin = true
+			_ = c.pipeW.Close()
+		} else {
+			log.Debugf("fin frame %x accepted, but conn not found", addressBuf)
+		}
+	} else if bytes.Equal(controlBuf, flagWindow) {
+		if len(dataBuf) < 4 {
+			return
+		}
+		inc := binary.BigEndian.Uint32(dataBuf)
+		if bytes.Equal(addressBuf, wsStream) {
+			ws.grant(nil, inc)
+		} else if c, ok := ws.stream(addressBuf); ok {
+			ws.grant(c, inc)
 		}
+	} else if bytes.Equal(controlBuf, flagAck) {
+		ws.acknowledged(dataBuf)
+	} else if bytes.Equal(controlBuf, flagLoop) {
+		_, _ = ws.writeFrame(addressBuf, flagClose, 0, dataBuf, flags&frameNoDelay == 0)
+	} else {
+		log.Warnf("unknown flag %q in frame %x", controlBuf, addressBuf)
 	}
 }
 
 func (ws *webSocket) writeData(prefix, flag, p []byte) (n int, err error) {
-	if ws.closed {
+	return ws.writeFrame(prefix, flag, 0, p, false)
+}
+
+// writeFrame writes a frame with the v2 header flags given, coalesced with
+// others if it may wait and the protocol allows.
+func (ws *webSocket) writeFrame(prefix, flag []byte, flags uint16, p []byte, later bool) (n int, err error) {
+	if ws.isClosed() {
 		return 0, fmt.Errorf("use of closed websocket")
 	}
 
-	err = ws.write(prefix, flag, p)
+	err = ws.write(prefix, flag, flags, p, later)
 
 	if err != nil {
 		log.Printf("error writing message with length %v, %v", len(p), err)
@@ -130,78 +314,168 @@ func (ws *webSocket) writeData(prefix, flag, p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func (ws *webSocket) write(prefix, flag, p []byte) (err error) {
+func (ws *webSocket) write(prefix, flag []byte, flags uint16, p []byte, later bool) (err error) {
 	ws.lock.Lock()
-	//log.Warn(len(prefix), len(flag), len(p), len(generateCode(p, ws.hashFunc)))
-	w, err := ws.conn.NextWriter(websocket.BinaryMessage)
+	defer ws.lock.Unlock()
+	if ws.version >= protocolV2 {
+		if ws.writeErr != nil {
+			return ws.writeErr
+		}
+		ws.pending = appendFrame(ws.pending, prefix, flag, flags, p)
+		return ws.queued(later)
+	}
+	w, err := ws.conn.nextWriter()
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(prefix)
-	_, err = w.Write(flag)
-	_, err = w.Write(p)
+	_, _ = w.Write(prefix)
+	_, _ = w.Write(flag)
+	_, _ = w.Write(p)
 	_, err = w.Write(generateCode(p, ws.hashFunc))
 	if err != nil {
+		_ = w.Close()
 		return err
 	}
-	err = w.Close()
-	w = nil
-	ws.lock.Unlock()
-	return
+	return w.Close()
+}
+
+// writeFrames sends v2 frames as one message, called holding ws.lock.
+func (ws *webSocket) writeFrames(frames []byte) error {
+	return ws.conn.writeFrames(frames, ws.hashFunc)
+}
+
+// nextWriter starts a message that has keepaliveTimeout to be written, so
+// that a peer no longer reading fails the websocket instead of blocking
+// everyone waiting on its lock, the reader included.
+func (c *wsConn) nextWriter() (io.WriteCloser, error) {
+	if keepaliveTimeout > 0 {
+		_ = c.SetWriteDeadline(time.Now().Add(keepaliveTimeout))
+	}
+	return c.NextWriter(websocket.BinaryMessage)
+}
+
+// writeFrames sends v2 frames as one message authenticated by hashFunc.
+func (c *wsConn) writeFrames(frames []byte, hashFunc func(b []byte, seed uint64) []byte) error {
+	w, err := c.nextWriter()
+	if err != nil {
+		return err
+	}
+	_, _ = w.Write(frames)
+	_, err = w.Write(generateCode(frames, hashFunc))
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
 }
 
 func (ws *webSocket) close() {
 	log.Warnf("websocket connection closed: %v", u64(ws.id))
-	ws.closed = true
-	wsPool.Delete(u64(ws.id))
+	atomic.StoreInt32(&ws.closed, 1)
+	wsPool.remove(ws)
+	if ws.session != nil {
+		if v, ok := sessions.Load(ws.session.token); ok && v == ws {
+			sessions.Delete(ws.session.token)
+		}
+	}
 	_ = ws.conn.Close()
+	ws.release(nil)
+
+	// streams can not outlive the websocket carrying them
+	ws.closeStreams()
 }
 
-func startWs(id []byte) (ws *webSocket) {
-	var conn *websocket.Conn
-	var err error
+// dialWs makes one attempt at a websocket to up, sending header along with
+// the authentication.
+func dialWs(up *upstream, header http.Header) (*websocket.Conn, *http.Response, error) {
 	newDialer := &websocket.Dialer{
 		ReadBufferSize:   wsReadBuf, // Expected average message size
 		WriteBufferSize:  wsWriteBuf,
 		HandshakeTimeout: 10 * time.Second,
 		TLSClientConfig:  &tlsConfig,
 	}
+	if wireVersion >= protocolV2 {
+		newDialer.Subprotocols = []string{subprotocolV2}
+	}
+	header.Set("Auth", hex.EncodeToString(generateCode([]byte("authenticate"+identity), hashWorker)))
+	header.Set("via", hashFlag)
+	header.Set("Identity", identity)
+	return newDialer.Dial(up.url, header)
+}
+
+func startWs(id []byte) (ws *webSocket) {
+	var conn *websocket.Conn
+	var resp *http.Response
+	var up *upstream
+	var err error
+	header := http.Header{}
+	token := ""
+	if wireVersion >= protocolV2 && resumeTimeout > 0 {
+		token = hex.EncodeToString(genRandBytes(16))
+		header.Set("Session", token)
+	}
 	for {
-		conn, _, err = newDialer.Dial(mainServer, map[string][]string{
-			"Auth": {hex.EncodeToString(generateCode([]byte("authenticate"), hashWorker))},
-			"via":  {hashFlag},
-		})
+		up = serverPool.pick()
+		conn, resp, err = dialWs(up, header)
+		serverPool.report(up, err)
 		if err == nil {
 			break
 		} else {
-			log.Warnf("dialing new websocket failed: %s", err.Error())
+			log.Warnf("dialing new websocket to %s failed: %s", up.url, err.Error())
 		}
 		time.Sleep(time.Second)
 	}
 	ws = &webSocket{
 		id:       id,
+		server:   up,
+		version:  wireVersionOf(conn),
+		flow:     newFlow(),
+		streams:  make(map[uint32]*muxConn),
+		nextID:   firstStreamID(true),
 		hashFunc: hashWorker,
 		conn:     &wsConn{conn},
-		closed:   false,
 		buf:      bytes.NewBuffer(make([]byte, 32*1024)),
 	}
+	// servers not keeping sessions leave the header out
+	if token != "" && ws.version >= protocolV2 && resp.Header.Get("Session") == token {
+		ws.session = newSession(token)
+	}
+	ws.startKeepalive()
 	taskAdd(func() {
 		err := ws.Reader()
+		timedOut := ws.unresponsive(err)
+		for ws.resume(err) {
+			err = ws.Reader()
+			timedOut = ws.unresponsive(err)
+		}
 		ws.close()
 		log.Warnf("websocket connection %v closed", u64(ws.id))
 		if err != nil {
 			log.Warn(err)
 		}
+		if timedOut {
+			log.Warnf("websocket connection %v unresponsive, replacing it", u64(ws.id))
+			wsPool.replace(ws)
+		}
 	})
 	return
 }
 
+// wireVersionOf returns the frame protocol agreed on during the upgrade.
+func wireVersionOf(conn *websocket.Conn) int {
+	if conn.Subprotocol() == subprotocolV2 {
+		return protocolV2
+	}
+	return protocolV1
+}
+
 func (ws *webSocket) Read() (err error) {
 	var r io.Reader
 	_, r, err = ws.conn.NextReader()
 	if err != nil {
 		return err
 	}
+	ws.alive()
 	ws.buf.Reset()
 	ws.buf.Grow(32 * 1024)
 	_, err = ws.buf.ReadFrom(r)